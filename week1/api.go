@@ -3,8 +3,12 @@ package week1
 import (
 	"context"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
 // вы можете использовать ApiError в коде, который получается в результате генерации
@@ -12,6 +16,10 @@ import (
 type ApiError struct {
 	HTTPStatus int
 	Err        error
+	// Code is a stable code of the error for clients, like user_exists
+	Code string
+	// Details are optional data of the error
+	Details map[string]interface{}
 }
 
 func (ae ApiError) Error() string {
@@ -26,15 +34,19 @@ const (
 	statusAdmin     = 20
 )
 
+// apigen:service {"prefix": "/user", "auth": true, "batch": true}
 type MyApi struct {
 	statuses map[string]int
 	users    map[string]*User
+	avatars  map[string][]byte
 	nextID   uint64
 	mu       *sync.RWMutex
+	// handler keeps middlewares, limits and metrics of the api
+	handler *MyApiHandler
 }
 
 func NewMyApi() *MyApi {
-	return &MyApi{
+	api := &MyApi{
 		statuses: map[string]int{
 			"user":      0,
 			"moderator": 10,
@@ -48,9 +60,27 @@ func NewMyApi() *MyApi {
 				Status:   statusAdmin,
 			},
 		},
-		nextID: 43,
-		mu:     &sync.RWMutex{},
+		avatars: map[string][]byte{},
+		nextID:  43,
+		mu:      &sync.RWMutex{},
 	}
+	h := NewMyApiHandler(api)
+	api.handler = h
+	h.RegisterMiddleware("nostore", noStore)
+	h.CORS = &CORSPolicy{
+		AllowOrigins: []string{"https://app.example.com"},
+		AllowHeaders: []string{"Content-Type", "X-Auth", "Idempotency-Key"},
+		MaxAge:       10 * time.Minute,
+	}
+	return api
+}
+
+// noStore forbids caching of responses with user data
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
 }
 
 type ProfileParams struct {
@@ -65,17 +95,17 @@ type CreateParams struct {
 }
 
 type User struct {
-	ID       uint64 `json:"id"`
-	Login    string `json:"login"`
-	FullName string `json:"full_name"`
-	Status   int    `json:"status"`
+	ID       uint64 `json:"id" xml:"id"`
+	Login    string `json:"login" xml:"login"`
+	FullName string `json:"full_name" xml:"full_name"`
+	Status   int    `json:"status" xml:"status"`
 }
 
 type NewUser struct {
-	ID uint64 `json:"id"`
+	ID uint64 `json:"id" xml:"id"`
 }
 
-// apigen:api {"url": "/user/profile", "auth": false}
+// apigen:api {"url": "/profile", "auth": false, "cache": "60s", "cors": {"origins": ["*"], "max_age": "1h", "expose_headers": ["ETag", "Deprecation", "Sunset", "Link"]}, "deprecated": {"sunset": "2027-01-01", "replacement": "/v2/user/profile"}}
 func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
 
 	if in.Login == "bad_user" {
@@ -86,13 +116,18 @@ func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error)
 	user, exist := srv.users[in.Login]
 	srv.mu.RUnlock()
 	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist"), Code: "user_not_found"}
 	}
 
 	return user, nil
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// apigen:api {"url": "/profile", "version": "v2", "auth": false, "cache": "60s", "cors": {"origins": ["*"], "max_age": "1h"}}
+func (srv *MyApi) ProfileV2(ctx context.Context, in ProfileParams) (*User, error) {
+	return srv.Profile(ctx, in)
+}
+
+// apigen:api {"url": "/create", "method": "POST", "middleware": ["nostore"], "rate": "10/s", "burst": 20, "key": "ip", "idempotent": true, "max_body": "1MB", "strict": true}
 func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
@@ -103,7 +138,12 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 
 	_, exist := srv.users[in.Login]
 	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
+		return nil, ApiError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("user %s exist", in.Login),
+			Code:       "user_exists",
+			Details:    map[string]interface{}{"login": in.Login},
+		}
 	}
 
 	id := srv.nextID
@@ -118,16 +158,97 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 	return &NewUser{id}, nil
 }
 
+type ExportParams struct {
+	Limit int `apivalidator:"min=0,max=1000"`
+}
+
+// sortedUsers returns at most limit users ordered by id, all of them if limit is 0
+func (srv *MyApi) sortedUsers(limit int) []*User {
+	srv.mu.RLock()
+	users := make([]*User, 0, len(srv.users))
+	for _, u := range srv.users {
+		users = append(users, u)
+	}
+	srv.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users
+}
+
+// apigen:api {"url": "/export", "stream": "ndjson"}
+func (srv *MyApi) Export(ctx context.Context, in ExportParams) (<-chan *User, error) {
+	users := srv.sortedUsers(in.Limit)
+	out := make(chan *User)
+	go func() {
+		defer close(out)
+		for _, u := range users {
+			select {
+			case out <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// apigen:api {"url": "/feed", "stream": "sse"}
+func (srv *MyApi) Feed(ctx context.Context, in ExportParams, send func(*User) error) error {
+	for _, u := range srv.sortedUsers(in.Limit) {
+		if err := send(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AvatarParams struct {
+	Login  string                `apivalidator:"required"`
+	Avatar *multipart.FileHeader `apivalidator:"required,maxsize=5MB,mimetype=image/png|image/jpeg"`
+}
+
+type AvatarInfo struct {
+	Login string `json:"login" xml:"login"`
+	Size  int64  `json:"size" xml:"size"`
+}
+
+// apigen:api {"url": "/avatar", "method": "POST", "max_body": "6MB"}
+func (srv *MyApi) Avatar(ctx context.Context, in AvatarParams) (*AvatarInfo, error) {
+	f, err := in.Avatar.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, exist := srv.users[in.Login]; !exist {
+		return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("user not exist"), Code: "user_not_found"}
+	}
+	srv.avatars[in.Login] = data
+	return &AvatarInfo{Login: in.Login, Size: int64(len(data))}, nil
+}
+
 // 2-я часть
 // это похожая структура, с теми же методами, но у них другие параметры!
 // код, созданный вашим кодогенератором работает с конкретной струткурой, про другие ничего не знает
 // поэтому то что рядом есть ещё походая структура с такими же методами его нисколько не смущает
 
+// apigen:service {"prefix": "/user", "mount": "/other", "auth": true}
 type OtherApi struct {
+	handler *OtherApiHandler
 }
 
 func NewOtherApi() *OtherApi {
-	return &OtherApi{}
+	api := &OtherApi{}
+	api.handler = NewOtherApiHandler(api)
+	return api
 }
 
 type OtherCreateParams struct {
@@ -144,7 +265,7 @@ type OtherUser struct {
 	Level    int    `json:"level"`
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+// apigen:api {"url": "/create", "method": "POST", "rate": "1/m", "burst": 5, "key": "auth"}
 func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
 	return &OtherUser{
 		ID:       12,
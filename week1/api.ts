@@ -0,0 +1,109 @@
+export class ApiError extends Error {
+  constructor(
+    public readonly status: number,
+    message: string,
+    public readonly code?: string,
+    public readonly details?: Record<string, unknown>,
+  ) {
+    super(message);
+    this.name = "ApiError";
+  }
+}
+
+export interface CreateParams {
+  login: string;
+  full_name?: string;
+  status?: "user" | "moderator" | "admin";
+  age: number;
+}
+
+export interface OtherCreateParams {
+  username: string;
+  account_name?: string;
+  class?: "warrior" | "sorcerer" | "rouge";
+  level: number;
+}
+
+export interface ProfileParams {
+  login: string;
+}
+
+export interface NewUser {
+  id: number;
+}
+
+export interface OtherUser {
+  id: number;
+  login: string;
+  full_name: string;
+  level: number;
+}
+
+export interface User {
+  id: number;
+  login: string;
+  full_name: string;
+  status: number;
+}
+
+interface Envelope<T> {
+  error: string;
+  code?: string;
+  details?: Record<string, unknown>;
+  response?: T;
+}
+
+async function call<T>(baseUrl: string, method: string, url: string, params: object, auth?: string): Promise<T> {
+  const query = new URLSearchParams();
+  for (const [k, v] of Object.entries(params)) {
+    if (v !== undefined && v !== null) {
+      query.append(k, String(v));
+    }
+  }
+  const headers: Record<string, string> = {};
+  if (auth !== undefined) {
+    headers["X-Auth"] = auth;
+  }
+  let resp: Response;
+  if (method === "GET") {
+    resp = await fetch(baseUrl + url + "?" + query.toString(), { method, headers });
+  } else {
+    headers["Content-Type"] = "application/x-www-form-urlencoded";
+    resp = await fetch(baseUrl + url, { method, headers, body: query });
+  }
+  let env: Envelope<T>;
+  try {
+    env = await resp.json();
+  } catch (e) {
+    throw new ApiError(resp.status, "bad response: " + e);
+  }
+  if (!resp.ok || env.error !== "") {
+    throw new ApiError(resp.status, env.error, env.code, env.details);
+  }
+  return env.response as T;
+}
+
+export class MyApiClient {
+  constructor(private readonly baseUrl: string, private readonly auth?: string) {}
+
+  /** @deprecated /user/profile goes away on 2027-01-01, use /v2/user/profile instead */
+  profile(params: ProfileParams): Promise<User> {
+    return call<User>(this.baseUrl, "GET", "/user/profile", params);
+  }
+
+  profileV2(params: ProfileParams): Promise<User> {
+    return call<User>(this.baseUrl, "GET", "/v2/user/profile", params);
+  }
+
+  create(params: CreateParams): Promise<NewUser> {
+    return call<NewUser>(this.baseUrl, "POST", "/user/create", params, this.auth);
+  }
+}
+
+export class OtherApiClient {
+  constructor(private readonly baseUrl: string, private readonly auth?: string) {}
+
+  create(params: OtherCreateParams): Promise<OtherUser> {
+    return call<OtherUser>(this.baseUrl, "POST", "/user/create", params, this.auth);
+  }
+}
@@ -0,0 +1,242 @@
+package week1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fuzzApigenHandler sends query and body as a form
+func fuzzApigenHandler(t *testing.T, h http.Handler, method, path, query, body string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.URL.RawQuery = query
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	fuzzApigenCheck(t, h, req, fmt.Sprintf("query %q body %q", query, body))
+}
+
+// fuzzApigenUpload sends fields, a query-encoded form, and file as every one
+// of files in a multipart/form-data body
+func fuzzApigenUpload(t *testing.T, h http.Handler, path, fields string, file []byte, files ...string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	values, _ := url.ParseQuery(fields)
+	for k, vv := range values {
+		for _, v := range vv {
+			mw.WriteField(k, v)
+		}
+	}
+	for _, name := range files {
+		part, _ := mw.CreateFormFile(name, name)
+		part.Write(file)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	fuzzApigenCheck(t, h, req, fmt.Sprintf("fields %q file %q", fields, file))
+}
+
+// fuzzApigenCheck checks that whatever params come in the handler answers
+// with a json envelope, or a stream of items and errors, and never treats
+// bad params as an internal error
+func fuzzApigenCheck(t *testing.T, h http.Handler, req *http.Request, desc string) {
+	req.Header.Set("X-Auth", "100500")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code == http.StatusInternalServerError {
+		t.Fatalf("internal error for %s: %s", desc, w.Body.String())
+	}
+	switch w.Header().Get("Content-Type") {
+	case "text/event-stream":
+		for _, event := range strings.Split(w.Body.String(), "\n\n") {
+			if event != "" && !strings.HasPrefix(event, "data: ") && !strings.HasPrefix(event, "event: error\ndata: ") {
+				t.Fatalf("bad event for %s: %q", desc, event)
+			}
+		}
+		return
+	case "application/x-ndjson":
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if line != "" && !json.Valid([]byte(line)) {
+				t.Fatalf("bad line for %s: %q", desc, line)
+			}
+		}
+		return
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cant unpack json for %s: %v", desc, err)
+	}
+	if _, ok := res["error"]; !ok {
+		t.Fatalf("no error key for %s: %s", desc, w.Body.String())
+	}
+}
+
+func FuzzHandlerMyApiProfile(f *testing.F) {
+	f.Add("login=a", "")
+	f.Add("", "login=a")
+	f.Add("", "")
+	mock := &MyApiMock{
+		ProfileFunc: func(ctx context.Context, in ProfileParams) (*User, error) {
+			return &User{}, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewMyApiHandler(mock)
+		fuzzApigenHandler(t, h, "GET", "/user/profile", query, body)
+	})
+}
+
+func FuzzHandlerMyApiProfileV2(f *testing.F) {
+	f.Add("login=a", "")
+	f.Add("", "login=a")
+	f.Add("", "")
+	mock := &MyApiMock{
+		ProfileV2Func: func(ctx context.Context, in ProfileParams) (*User, error) {
+			return &User{}, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewMyApiHandler(mock)
+		fuzzApigenHandler(t, h, "GET", "/v2/user/profile", query, body)
+	})
+}
+
+func FuzzHandlerMyApiCreate(f *testing.F) {
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa&status=user", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaaa&status=user")
+	f.Add("age=0&full_name=a&status=user", "")
+	f.Add("", "age=0&full_name=a&status=user")
+	f.Add("age=0&full_name=a&login=aaaaaaaaa&status=user", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaa&status=user")
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa&status=moderator", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaaa&status=moderator")
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa&status=admin", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaaa&status=admin")
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa&status=apigen_invalid", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaaa&status=apigen_invalid")
+	f.Add("age=0&full_name=a&login=aaaaaaaaaa", "")
+	f.Add("", "age=0&full_name=a&login=aaaaaaaaaa")
+	f.Add("age=x&full_name=a&login=aaaaaaaaaa&status=user", "")
+	f.Add("", "age=x&full_name=a&login=aaaaaaaaaa&status=user")
+	f.Add("age=-1&full_name=a&login=aaaaaaaaaa&status=user", "")
+	f.Add("", "age=-1&full_name=a&login=aaaaaaaaaa&status=user")
+	f.Add("age=128&full_name=a&login=aaaaaaaaaa&status=user", "")
+	f.Add("", "age=128&full_name=a&login=aaaaaaaaaa&status=user")
+	f.Add("age=129&full_name=a&login=aaaaaaaaaa&status=user", "")
+	f.Add("", "age=129&full_name=a&login=aaaaaaaaaa&status=user")
+	mock := &MyApiMock{
+		CreateFunc: func(ctx context.Context, in CreateParams) (*NewUser, error) {
+			return &NewUser{}, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewMyApiHandler(mock)
+		h.RegisterMiddleware("nostore", func(next http.Handler) http.Handler { return next })
+		fuzzApigenHandler(t, h, "POST", "/user/create", query, body)
+	})
+}
+
+func FuzzHandlerMyApiExport(f *testing.F) {
+	f.Add("limit=0", "")
+	f.Add("", "limit=0")
+	f.Add("limit=x", "")
+	f.Add("", "limit=x")
+	f.Add("limit=-1", "")
+	f.Add("", "limit=-1")
+	f.Add("limit=1000", "")
+	f.Add("", "limit=1000")
+	f.Add("limit=1001", "")
+	f.Add("", "limit=1001")
+	mock := &MyApiMock{
+		ExportFunc: func(ctx context.Context, in ExportParams) (<-chan *User, error) {
+			var item *User
+			items := make(chan *User, 1)
+			items <- item
+			close(items)
+			return items, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewMyApiHandler(mock)
+		fuzzApigenHandler(t, h, "GET", "/user/export", query, body)
+	})
+}
+
+func FuzzHandlerMyApiFeed(f *testing.F) {
+	f.Add("limit=0", "")
+	f.Add("", "limit=0")
+	f.Add("limit=x", "")
+	f.Add("", "limit=x")
+	f.Add("limit=-1", "")
+	f.Add("", "limit=-1")
+	f.Add("limit=1000", "")
+	f.Add("", "limit=1000")
+	f.Add("limit=1001", "")
+	f.Add("", "limit=1001")
+	mock := &MyApiMock{
+		FeedFunc: func(ctx context.Context, in ExportParams, send func(*User) error) error {
+			var item *User
+			return send(item)
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewMyApiHandler(mock)
+		fuzzApigenHandler(t, h, "GET", "/user/feed", query, body)
+	})
+}
+
+func FuzzHandlerMyApiAvatar(f *testing.F) {
+	f.Add("login=a", []byte("\x89PNG\r\n\x1a\n"))
+	f.Add("login=a", []byte(""))
+	f.Add("", []byte("\x89PNG\r\n\x1a\n"))
+	f.Add("", []byte(""))
+	mock := &MyApiMock{
+		AvatarFunc: func(ctx context.Context, in AvatarParams) (*AvatarInfo, error) {
+			return &AvatarInfo{}, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, fields string, file []byte) {
+		h := NewMyApiHandler(mock)
+		fuzzApigenUpload(t, h, "/user/avatar", fields, file, "avatar")
+	})
+}
+
+func FuzzHandlerOtherApiCreate(f *testing.F) {
+	f.Add("account_name=a&class=warrior&level=1&username=aaa", "")
+	f.Add("", "account_name=a&class=warrior&level=1&username=aaa")
+	f.Add("account_name=a&class=warrior&level=1", "")
+	f.Add("", "account_name=a&class=warrior&level=1")
+	f.Add("account_name=a&class=warrior&level=1&username=aa", "")
+	f.Add("", "account_name=a&class=warrior&level=1&username=aa")
+	f.Add("account_name=a&class=sorcerer&level=1&username=aaa", "")
+	f.Add("", "account_name=a&class=sorcerer&level=1&username=aaa")
+	f.Add("account_name=a&class=rouge&level=1&username=aaa", "")
+	f.Add("", "account_name=a&class=rouge&level=1&username=aaa")
+	f.Add("account_name=a&class=apigen_invalid&level=1&username=aaa", "")
+	f.Add("", "account_name=a&class=apigen_invalid&level=1&username=aaa")
+	f.Add("account_name=a&level=1&username=aaa", "")
+	f.Add("", "account_name=a&level=1&username=aaa")
+	f.Add("account_name=a&class=warrior&level=x&username=aaa", "")
+	f.Add("", "account_name=a&class=warrior&level=x&username=aaa")
+	f.Add("account_name=a&class=warrior&level=0&username=aaa", "")
+	f.Add("", "account_name=a&class=warrior&level=0&username=aaa")
+	f.Add("account_name=a&class=warrior&level=50&username=aaa", "")
+	f.Add("", "account_name=a&class=warrior&level=50&username=aaa")
+	f.Add("account_name=a&class=warrior&level=51&username=aaa", "")
+	f.Add("", "account_name=a&class=warrior&level=51&username=aaa")
+	mock := &OtherApiMock{
+		CreateFunc: func(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+			return &OtherUser{}, nil
+		},
+	}
+	f.Fuzz(func(t *testing.T, query, body string) {
+		h := NewOtherApiHandler(mock)
+		fuzzApigenHandler(t, h, "POST", "/user/create", query, body)
+	})
+}
@@ -3,149 +3,472 @@ package week1
 import "net/http"
 import "encoding/json"
 import "context"
-import "reflect"
 import "fmt"
 import "strings"
 import "strconv"
+import "log"
+import "runtime/debug"
+import "sync"
+import "time"
+import "math"
+import "net"
+import "sort"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "bytes"
+import "net/url"
+import "encoding/xml"
+import "io"
+import "mime/multipart"
+import "errors"
 
+// MyApiService is the set of MyApi methods served over http
+type MyApiService interface {
+	Profile(ctx context.Context, in ProfileParams) (*User, error)
+	ProfileV2(ctx context.Context, in ProfileParams) (*User, error)
+	Create(ctx context.Context, in CreateParams) (*NewUser, error)
+	Export(ctx context.Context, in ExportParams) (<-chan *User, error)
+	Feed(ctx context.Context, in ExportParams, send func(*User) error) error
+	Avatar(ctx context.Context, in AvatarParams) (*AvatarInfo, error)
+}
+
+// MyApiHandler serves any MyApiService implementation
+type MyApiHandler struct {
+	Service MyApiService
+	// Prefix is the path the endpoints are mounted at, routes are matched relative to it
+	Prefix string
+	// AccessLog gets a json line per request, it is off while nil
+	AccessLog *log.Logger
+	// Idempotency keeps responses of idempotent endpoints for IdempotencyTTL
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	// CORS is the policy of endpoints without one in their annotation,
+	// nil forbids calls from other origins
+	CORS        *CORSPolicy
+	cors        map[string]*CORSPolicy
+	mu          sync.RWMutex
+	middlewares map[string]func(http.Handler) http.Handler
+	// chains are endpoints wrapped into their middlewares, nil until the first request
+	chains      map[string]http.Handler
+	metrics     *apigenMetrics
+	idempotency *apigenIdempotency
+	// MaxBatch is the most requests a batch may have, BatchConcurrency
+	// is how many of them run at once
+	MaxBatch         int
+	BatchConcurrency int
+	// MaxBatchBody is the most bytes a batch body may have, 0 is no limit.
+	// It defaults to the largest max_body of the endpoints.
+	MaxBatchBody  int64
+	limiterCreate *rateLimiter
+}
+
+func NewMyApiHandler(svc MyApiService) *MyApiHandler {
+	return &MyApiHandler{
+		Service:          svc,
+		Prefix:           "/user",
+		Idempotency:      NewMemoryIdempotencyStore(),
+		IdempotencyTTL:   24 * time.Hour,
+		middlewares:      make(map[string]func(http.Handler) http.Handler),
+		metrics:          newApigenMetrics("MyApi"),
+		idempotency:      newApigenIdempotency(),
+		MaxBatch:         20,
+		BatchConcurrency: 4,
+		MaxBatchBody:     1048576,
+		cors: map[string]*CORSPolicy{
+			"/profile": {
+				AllowOrigins:  []string{"*"},
+				ExposeHeaders: []string{"ETag", "Deprecation", "Sunset", "Link"},
+				MaxAge:        3600 * time.Second,
+			},
+			"/v2/profile": {
+				AllowOrigins: []string{"*"},
+				MaxAge:       3600 * time.Second,
+			},
+		},
+		limiterCreate: newRateLimiter(10, 20),
+	}
+}
+
+// Handler returns the handler kept in h.handler, the constructor of
+// MyApi makes it with NewMyApiHandler
+func (h *MyApi) Handler() *MyApiHandler {
+	return h.handler
+}
+
+// ServeHTTP serves h with its Handler, which keeps middlewares, limits
+// and metrics between requests
 func (h *MyApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/user/profile":
-		h.handlerProfile(w, r)
-	case "/user/create":
-		h.handlerCreate(w, r)
-	default:
+	if h.handler == nil {
+		log.Print("MyApi: handler is not set, make it with NewMyApiHandler")
+		writeError(w, r, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+var middlewaresMyApi = []string{"nostore"}
+
+// RegisterMiddleware makes mw available to endpoints listing name in their
+// "middleware" annotation
+func (h *MyApiHandler) RegisterMiddleware(name string, mw func(http.Handler) http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.middlewares[name] = mw
+	h.chains = nil
+}
+
+// Check reports middlewares listed in annotations but not registered,
+// endpoints using them answer with internal errors
+func (h *MyApiHandler) Check() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.check()
+}
+
+func (h *MyApiHandler) check() error {
+	missing := make([]string, 0)
+	for _, name := range middlewaresMyApi {
+		if _, ok := h.middlewares[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("MyApi: middleware %s is not registered", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MetricsHandler serves metrics of the endpoints in prometheus text format,
+// they are also available at <prefix>/_meta/metrics
+func (h *MyApiHandler) MetricsHandler() http.Handler {
+	return h.metrics
+}
+
+// endpoint returns the endpoint at key wrapped into its middlewares, nil if
+// one of them is not registered. Chains are built once middlewares change.
+func (h *MyApiHandler) endpoint(key string) http.Handler {
+	h.mu.RLock()
+	chains := h.chains
+	h.mu.RUnlock()
+	if chains == nil {
+		chains = h.buildChains()
+	}
+	return chains[key]
+}
+
+func (h *MyApiHandler) buildChains() map[string]http.Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.chains != nil {
+		return h.chains
+	}
+	if err := h.check(); err != nil {
+		log.Print(err)
+	}
+	h.chains = make(map[string]http.Handler)
+	h.chains["/create"] = h.chain(http.HandlerFunc(h.handlerCreate), "nostore")
+	return h.chains
+}
+
+// chain wraps next into the named middlewares, the first one is the outermost.
+// Middlewares run before the auth, method and params checks of the endpoint.
+func (h *MyApiHandler) chain(next http.Handler, names ...string) http.Handler {
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, ok := h.middlewares[names[i]]
+		if !ok {
+			return nil
+		}
+		next = mw(next)
+	}
+	return next
+}
+
+var versionsMyApi = []string{"v2"}
+
+var routeMethodsMyApi = map[string][]string{
+	"/profile":            {"GET", "POST"},
+	"/v2/profile":         {"GET", "POST"},
+	"/create":             {"POST"},
+	"/export":             {"GET", "POST"},
+	"/feed":               {"GET", "POST"},
+	"/avatar":             {"POST"},
+	"/_meta/routes":       {"GET"},
+	"/_meta/openapi.json": {"GET"},
+	"/_meta/metrics":      {"GET"},
+	"/_batch":             {"POST"},
+}
+
+func (h *MyApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, path := splitVersion(r.URL.Path, versionsMyApi)
+	if strings.HasPrefix(path, h.Prefix) {
+		path = version + path[len(h.Prefix):]
+	} else {
+		path = ""
+	}
+	h.serve(w, r, path)
+}
+
+// RegisterRoutes mounts the endpoints and meta paths of h at prefix in mux,
+// the prefix is used instead of h.Prefix. Versioned endpoints go to /<version><prefix>.
+// It fails if h misses middlewares, they must be registered before.
+func (h *MyApiHandler) RegisterRoutes(mux *http.ServeMux, prefix string) error {
+	if err := h.Check(); err != nil {
+		return err
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, path := splitVersion(r.URL.Path, versionsMyApi)
+		h.serve(w, r, version+strings.TrimPrefix(path, prefix))
+	})
+	for key := range routeMethodsMyApi {
+		version, route := splitVersion(key, versionsMyApi)
+		mux.Handle(version+prefix+route, serve)
+	}
+	return nil
+}
+
+// serve handles the request to path, it is the version and the url relative to the prefix
+func (h *MyApiHandler) serve(w http.ResponseWriter, r *http.Request, path string) {
+	if methods, ok := routeMethodsMyApi[path]; ok {
+		policy := h.CORS
+		if p, ok := h.cors[path]; ok {
+			policy = p
+		}
+		if serveCORS(w, r, policy, methods) {
+			return
+		}
+	}
+	switch path {
+	case "/profile":
+		call, r := beginCall(w, r, "/user/profile", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.Profile")
+		setDeprecated(call, "Fri, 01 Jan 2027 00:00:00 GMT", "/v2/user/profile")
+		h.metrics.deprecatedCall("/user/profile")
+		h.handlerProfile(call, r)
+	case "/v2/profile":
+		call, r := beginCall(w, r, "/v2/user/profile", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.ProfileV2")
+		h.handlerProfileV2(call, r)
+	case "/create":
+		call, r := beginCall(w, r, "/user/create", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.Create")
+		if next := h.endpoint("/create"); next != nil {
+			next.ServeHTTP(call, r)
+		} else {
+			// the missing middleware is logged once, Check tells about it
+			setResult(r, "error")
+			writeError(call, r, http.StatusInternalServerError, "internal", "internal error")
+		}
+	case "/export":
+		call, r := beginCall(w, r, "/user/export", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.Export")
+		h.handlerExport(call, r)
+	case "/feed":
+		call, r := beginCall(w, r, "/user/feed", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.Feed")
+		h.handlerFeed(call, r)
+	case "/avatar":
+		call, r := beginCall(w, r, "/user/avatar", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "MyApi.Avatar")
+		h.handlerAvatar(call, r)
+	case "/_meta/routes":
 		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unknown method"}
-		body, _ := json.Marshal(res)
+		w.Write([]byte(routesMyApi))
+	case "/_meta/openapi.json":
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write(body)
+		w.Write([]byte(openapiMyApi))
+	case "/_meta/metrics":
+		h.metrics.ServeHTTP(w, r)
+	case "/_batch":
+		// urls of the batch are relative to where the batch is served
+		prefix := strings.TrimSuffix(r.URL.Path, "/_batch")
+		serveBatch(w, r, h.MaxBatch, h.BatchConcurrency, h.MaxBatchBody, func(w http.ResponseWriter, r *http.Request) {
+			version, path := splitVersion(r.URL.Path, versionsMyApi)
+			key := ""
+			if strings.HasPrefix(path, prefix) {
+				key = version + path[len(prefix):]
+			}
+			if key == "/_batch" {
+				// batches do not nest
+				key = ""
+			}
+			h.serve(w, r, key)
+		})
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "unknown method")
 		return
 	}
 }
-func (h *MyApi) handlerProfile(w http.ResponseWriter, r *http.Request) {
+func (h *MyApiHandler) handlerProfile(w http.ResponseWriter, r *http.Request) {
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
+		return
+	}
 	// 3. заполнение структуры params
 	var vErr *ApiError
 	valLogin, vErr := FillValue("Login", "string", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	params := ProfileParams{
 		Login: valLogin.(string),
 	}
 	// 4. валидирование параметров
-	valErr := ValidateProfileParams(params)
+	valErr := ValidateProfileParams(&params)
 	if valErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": valErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(valErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
-	ctx := context.Background()
-	answer, err := h.Profile(ctx, params)
+	ctx := r.Context()
+	answer, err := h.Service.Profile(ctx, params)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": err.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		if err, ok := err.(ApiError); ok {
-			w.WriteHeader(err.HTTPStatus)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		setResult(r, "error")
+		writeApiError(w, r, err)
+		return
+	}
+	body, contentType := encodeResponse(r, answer)
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		etag := etagOf(body)
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
 		}
-		w.Write(body)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+	// прочие обработки
+}
+func (h *MyApiHandler) handlerProfileV2(w http.ResponseWriter, r *http.Request) {
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
 		return
 	}
-	res := map[string]interface{}{
-		"error":    "",
-		"response": answer,
+	// 3. заполнение структуры params
+	var vErr *ApiError
+	valLogin, vErr := FillValue("Login", "string", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
 	}
-	body, _ := json.Marshal(res)
-	w.Header().Set("Content-Type", "application/json")
+	params := ProfileParams{
+		Login: valLogin.(string),
+	}
+	// 4. валидирование параметров
+	valErr := ValidateProfileParams(&params)
+	if valErr != nil {
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
+		return
+	}
+	ctx := r.Context()
+	answer, err := h.Service.ProfileV2(ctx, params)
+	if err != nil {
+		setResult(r, "error")
+		writeApiError(w, r, err)
+		return
+	}
+	body, contentType := encodeResponse(r, answer)
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		etag := etagOf(body)
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.Write(body)
 	// прочие обработки
 }
-func (h *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
+func (h *MyApiHandler) handlerCreate(w http.ResponseWriter, r *http.Request) {
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
+		return
+	}
+	// 0. ограничение частоты запросов
+	if ok, wait := h.limiterCreate.allow(rateKeyIP(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests")
+		return
+	}
 	// 1. проверка авторизации
 	if h, ok := r.Header["X-Auth"]; ok {
 		if h[0] != "100500" {
-			w.Header().Set("Content-Type", "application/json")
-			res := map[string]string{"error": "unauthorized"}
-			body, _ := json.Marshal(res)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			w.Write(body)
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
 			return
 		}
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unauthorized"}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write(body)
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
 		return
 	}
 	// 2. проверки метода (GET/POST)
-	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "bad method"}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write(body)
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	// 2.1 размер тела и неизвестные параметры
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	if vErr := readForm(r); vErr != nil {
+		setResult(r, "invalid")
+		writeApiError(w, r, vErr)
+		return
+	}
+	if vErr := checkParams(r, "login", "full_name", "status", "age"); vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
+	// 2.2 повтор запроса с тем же Idempotency-Key
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		iw, done := h.idempotency.begin(w, r, h.Idempotency, h.IdempotencyTTL, "/user/create", key)
+		if done {
+			return
+		}
+		defer iw.finish()
+		w = iw
+	}
 	// 3. заполнение структуры params
 	var vErr *ApiError
 	valLogin, vErr := FillValue("Login", "string", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	valName, vErr := FillValue("full_name", "string", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	valStatus, vErr := FillValue("Status", "string", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	valAge, vErr := FillValue("Age", "int", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	params := CreateParams{
@@ -155,168 +478,479 @@ func (h *MyApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
 		Age:    valAge.(int),
 	}
 	// 4. валидирование параметров
-	valErr := ValidateCreateParams(params)
+	valErr := ValidateCreateParams(&params)
 	if valErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": valErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(valErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
-	ctx := context.Background()
-	answer, err := h.Create(ctx, params)
+	ctx := r.Context()
+	answer, err := h.Service.Create(ctx, params)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": err.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		if err, ok := err.(ApiError); ok {
-			w.WriteHeader(err.HTTPStatus)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		w.Write(body)
+		setResult(r, "error")
+		writeApiError(w, r, err)
 		return
 	}
-	res := map[string]interface{}{
-		"error":    "",
-		"response": answer,
-	}
-	body, _ := json.Marshal(res)
-	w.Header().Set("Content-Type", "application/json")
+	body, contentType := encodeResponse(r, answer)
+	w.Header().Set("Content-Type", contentType)
 	w.Write(body)
 	// прочие обработки
 }
-func (h *OtherApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
-	case "/user/create":
-		h.handlerCreate(w, r)
-	default:
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unknown method"}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write(body)
+func (h *MyApiHandler) handlerExport(w http.ResponseWriter, r *http.Request) {
+	// 1. проверка авторизации
+	if h, ok := r.Header["X-Auth"]; ok {
+		if h[0] != "100500" {
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+			return
+		}
+	} else {
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+		return
+	}
+	// 3. заполнение структуры params
+	var vErr *ApiError
+	valLimit, vErr := FillValue("Limit", "int", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	params := ExportParams{
+		Limit: valLimit.(int),
+	}
+	// 4. валидирование параметров
+	valErr := ValidateExportParams(&params)
+	if valErr != nil {
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
+	ctx := r.Context()
+	stream := newApigenStream(w, r, "ndjson")
+	items, err := h.Service.Export(ctx, params)
+	if err == nil {
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break loop
+			case item, ok := <-items:
+				if !ok {
+					break loop
+				}
+				if err = stream.send(item); err != nil {
+					break loop
+				}
+			}
+		}
+	}
+	stream.end(err)
+	// прочие обработки
 }
-func (h *OtherApi) handlerCreate(w http.ResponseWriter, r *http.Request) {
+func (h *MyApiHandler) handlerFeed(w http.ResponseWriter, r *http.Request) {
 	// 1. проверка авторизации
 	if h, ok := r.Header["X-Auth"]; ok {
 		if h[0] != "100500" {
-			w.Header().Set("Content-Type", "application/json")
-			res := map[string]string{"error": "unauthorized"}
-			body, _ := json.Marshal(res)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			w.Write(body)
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
 			return
 		}
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unauthorized"}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write(body)
-		return
-	}
-	// 2. проверки метода (GET/POST)
-	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "bad method"}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write(body)
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
 		return
 	}
 	// 3. заполнение структуры params
 	var vErr *ApiError
-	valUsername, vErr := FillValue("Username", "string", r)
+	valLimit, vErr := FillValue("Limit", "int", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
-	valName, vErr := FillValue("account_name", "string", r)
-	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+	params := ExportParams{
+		Limit: valLimit.(int),
+	}
+	// 4. валидирование параметров
+	valErr := ValidateExportParams(&params)
+	if valErr != nil {
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
-	valClass, vErr := FillValue("Class", "string", r)
+	ctx := r.Context()
+	stream := newApigenStream(w, r, "sse")
+	err := h.Service.Feed(ctx, params, func(item *User) error {
+		return stream.send(item)
+	})
+	stream.end(err)
+	// прочие обработки
+}
+func (h *MyApiHandler) handlerAvatar(w http.ResponseWriter, r *http.Request) {
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
+		return
+	}
+	// 1. проверка авторизации
+	if h, ok := r.Header["X-Auth"]; ok {
+		if h[0] != "100500" {
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+			return
+		}
+	} else {
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+		return
+	}
+	// 2. проверки метода (GET/POST)
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	// 2.1 размер тела и неизвестные параметры
+	r.Body = http.MaxBytesReader(w, r.Body, 6291456)
+	if vErr := readForm(r); vErr != nil {
+		setResult(r, "invalid")
+		writeApiError(w, r, vErr)
+		return
+	}
+	// 3. заполнение структуры params
+	var vErr *ApiError
+	valLogin, vErr := FillValue("Login", "string", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
-	valLevel, vErr := FillValue("Level", "int", r)
+	valAvatar, vErr := FillFile("avatar", "*multipart.FileHeader", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
-	params := OtherCreateParams{
-		Username: valUsername.(string),
-		Name:     valName.(string),
-		Class:    valClass.(string),
-		Level:    valLevel.(int),
+	params := AvatarParams{
+		Login:  valLogin.(string),
+		Avatar: valAvatar.(*multipart.FileHeader),
 	}
 	// 4. валидирование параметров
-	valErr := ValidateOtherCreateParams(params)
+	valErr := ValidateAvatarParams(&params)
 	if valErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": valErr.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(valErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
-	ctx := context.Background()
-	answer, err := h.Create(ctx, params)
+	ctx := r.Context()
+	answer, err := h.Service.Avatar(ctx, params)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": err.Error()}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		if err, ok := err.(ApiError); ok {
-			w.WriteHeader(err.HTTPStatus)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		w.Write(body)
+		setResult(r, "error")
+		writeApiError(w, r, err)
 		return
 	}
-	res := map[string]interface{}{
-		"error":    "",
-		"response": answer,
-	}
-	body, _ := json.Marshal(res)
-	w.Header().Set("Content-Type", "application/json")
+	body, contentType := encodeResponse(r, answer)
+	w.Header().Set("Content-Type", contentType)
 	w.Write(body)
 	// прочие обработки
 }
+
+// OtherApiService is the set of OtherApi methods served over http
+type OtherApiService interface {
+	Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error)
+}
+
+// OtherApiHandler serves any OtherApiService implementation
+type OtherApiHandler struct {
+	Service OtherApiService
+	// Prefix is the path the endpoints are mounted at, routes are matched relative to it
+	Prefix string
+	// AccessLog gets a json line per request, it is off while nil
+	AccessLog *log.Logger
+	// Idempotency keeps responses of idempotent endpoints for IdempotencyTTL
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	// CORS is the policy of endpoints without one in their annotation,
+	// nil forbids calls from other origins
+	CORS        *CORSPolicy
+	cors        map[string]*CORSPolicy
+	mu          sync.RWMutex
+	middlewares map[string]func(http.Handler) http.Handler
+	// chains are endpoints wrapped into their middlewares, nil until the first request
+	chains        map[string]http.Handler
+	metrics       *apigenMetrics
+	idempotency   *apigenIdempotency
+	limiterCreate *rateLimiter
+}
+
+func NewOtherApiHandler(svc OtherApiService) *OtherApiHandler {
+	return &OtherApiHandler{
+		Service:        svc,
+		Prefix:         "/user",
+		Idempotency:    NewMemoryIdempotencyStore(),
+		IdempotencyTTL: 24 * time.Hour,
+		middlewares:    make(map[string]func(http.Handler) http.Handler),
+		metrics:        newApigenMetrics("OtherApi"),
+		idempotency:    newApigenIdempotency(),
+		cors:           map[string]*CORSPolicy{},
+		limiterCreate:  newRateLimiter(0.016666666666666666, 5),
+	}
+}
+
+// Handler returns the handler kept in h.handler, the constructor of
+// OtherApi makes it with NewOtherApiHandler
+func (h *OtherApi) Handler() *OtherApiHandler {
+	return h.handler
+}
+
+// ServeHTTP serves h with its Handler, which keeps middlewares, limits
+// and metrics between requests
+func (h *OtherApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.handler == nil {
+		log.Print("OtherApi: handler is not set, make it with NewOtherApiHandler")
+		writeError(w, r, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+var middlewaresOtherApi = []string{}
+
+// RegisterMiddleware makes mw available to endpoints listing name in their
+// "middleware" annotation
+func (h *OtherApiHandler) RegisterMiddleware(name string, mw func(http.Handler) http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.middlewares[name] = mw
+	h.chains = nil
+}
+
+// Check reports middlewares listed in annotations but not registered,
+// endpoints using them answer with internal errors
+func (h *OtherApiHandler) Check() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.check()
+}
+
+func (h *OtherApiHandler) check() error {
+	missing := make([]string, 0)
+	for _, name := range middlewaresOtherApi {
+		if _, ok := h.middlewares[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("OtherApi: middleware %s is not registered", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MetricsHandler serves metrics of the endpoints in prometheus text format,
+// they are also available at <prefix>/_meta/metrics
+func (h *OtherApiHandler) MetricsHandler() http.Handler {
+	return h.metrics
+}
+
+// endpoint returns the endpoint at key wrapped into its middlewares, nil if
+// one of them is not registered. Chains are built once middlewares change.
+func (h *OtherApiHandler) endpoint(key string) http.Handler {
+	h.mu.RLock()
+	chains := h.chains
+	h.mu.RUnlock()
+	if chains == nil {
+		chains = h.buildChains()
+	}
+	return chains[key]
+}
+
+func (h *OtherApiHandler) buildChains() map[string]http.Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.chains != nil {
+		return h.chains
+	}
+	if err := h.check(); err != nil {
+		log.Print(err)
+	}
+	h.chains = make(map[string]http.Handler)
+	return h.chains
+}
+
+// chain wraps next into the named middlewares, the first one is the outermost.
+// Middlewares run before the auth, method and params checks of the endpoint.
+func (h *OtherApiHandler) chain(next http.Handler, names ...string) http.Handler {
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, ok := h.middlewares[names[i]]
+		if !ok {
+			return nil
+		}
+		next = mw(next)
+	}
+	return next
+}
+
+var versionsOtherApi = []string{}
+
+var routeMethodsOtherApi = map[string][]string{
+	"/create":             {"POST"},
+	"/_meta/routes":       {"GET"},
+	"/_meta/openapi.json": {"GET"},
+	"/_meta/metrics":      {"GET"},
+}
+
+func (h *OtherApiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, path := splitVersion(r.URL.Path, versionsOtherApi)
+	if strings.HasPrefix(path, h.Prefix) {
+		path = version + path[len(h.Prefix):]
+	} else {
+		path = ""
+	}
+	h.serve(w, r, path)
+}
+
+// RegisterRoutes mounts the endpoints and meta paths of h at prefix in mux,
+// the prefix is used instead of h.Prefix. Versioned endpoints go to /<version><prefix>.
+// It fails if h misses middlewares, they must be registered before.
+func (h *OtherApiHandler) RegisterRoutes(mux *http.ServeMux, prefix string) error {
+	if err := h.Check(); err != nil {
+		return err
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, path := splitVersion(r.URL.Path, versionsOtherApi)
+		h.serve(w, r, version+strings.TrimPrefix(path, prefix))
+	})
+	for key := range routeMethodsOtherApi {
+		version, route := splitVersion(key, versionsOtherApi)
+		mux.Handle(version+prefix+route, serve)
+	}
+	return nil
+}
+
+// serve handles the request to path, it is the version and the url relative to the prefix
+func (h *OtherApiHandler) serve(w http.ResponseWriter, r *http.Request, path string) {
+	if methods, ok := routeMethodsOtherApi[path]; ok {
+		policy := h.CORS
+		if p, ok := h.cors[path]; ok {
+			policy = p
+		}
+		if serveCORS(w, r, policy, methods) {
+			return
+		}
+	}
+	switch path {
+	case "/create":
+		call, r := beginCall(w, r, "/user/create", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "OtherApi.Create")
+		h.handlerCreate(call, r)
+	case "/_meta/routes":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(routesOtherApi))
+	case "/_meta/openapi.json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openapiOtherApi))
+	case "/_meta/metrics":
+		h.metrics.ServeHTTP(w, r)
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "unknown method")
+		return
+	}
+}
+func (h *OtherApiHandler) handlerCreate(w http.ResponseWriter, r *http.Request) {
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
+		return
+	}
+	// 1. проверка авторизации
+	if h, ok := r.Header["X-Auth"]; ok {
+		if h[0] != "100500" {
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+			return
+		}
+	} else {
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+		return
+	}
+	// 1.1 ограничение частоты запросов по проверенному токену
+	if ok, wait := h.limiterCreate.allow(rateKeyAuth(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests")
+		return
+	}
+	// 2. проверки метода (GET/POST)
+	if r.Method != "POST" {
+		writeError(w, r, http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	// 3. заполнение структуры params
+	var vErr *ApiError
+	valUsername, vErr := FillValue("Username", "string", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	valName, vErr := FillValue("account_name", "string", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	valClass, vErr := FillValue("Class", "string", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	valLevel, vErr := FillValue("Level", "int", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	params := OtherCreateParams{
+		Username: valUsername.(string),
+		Name:     valName.(string),
+		Class:    valClass.(string),
+		Level:    valLevel.(int),
+	}
+	// 4. валидирование параметров
+	valErr := ValidateOtherCreateParams(&params)
+	if valErr != nil {
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
+		return
+	}
+	ctx := r.Context()
+	answer, err := h.Service.Create(ctx, params)
+	if err != nil {
+		setResult(r, "error")
+		writeApiError(w, r, err)
+		return
+	}
+	body, contentType := encodeResponse(r, answer)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+	// прочие обработки
+}
+
+// recoverPanic answers with an internal error if the handler panics,
+// the panic value goes only to the log. A response already started, like
+// a stream, is just ended. http.ErrAbortHandler is panicked on, so that
+// the server aborts the response.
+func recoverPanic(call *apigenCall, r *http.Request, endpoint string) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+	log.Printf("%s panic: %v\n%s", endpoint, rec, debug.Stack())
+	call.result = "panic"
+	if call.status == 0 {
+		writeError(call, r, http.StatusInternalServerError, "internal", "internal error")
+	}
+}
+
 func FillValue(n, t string, r *http.Request) (interface{}, *ApiError) {
 	n = strings.ToLower(n)
 	val := r.FormValue(n)
@@ -325,7 +959,7 @@ func FillValue(n, t string, r *http.Request) (interface{}, *ApiError) {
 		if err != nil {
 			return 0, &ApiError{
 				HTTPStatus: http.StatusBadRequest,
-				Err:        fmt.Errorf("%s must be %s", n, t),
+				Err:        newValidationError(n, "type", "type", n, t),
 			}
 		}
 		return res, nil
@@ -333,138 +967,2619 @@ func FillValue(n, t string, r *http.Request) (interface{}, *ApiError) {
 	return val, nil
 }
 
-func ValidateCreateParams(param CreateParams) *ApiError {
-	var e reflect.Value
+func ValidateAvatarParams(param *AvatarParams) *ApiError {
+	// validate Login field
+	// validate required status
+	if param.Login == "" {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("login", "required", "required", strings.ToLower("Login")),
+		}
+	}
+	// validate Avatar field
+	// validate required status
+	if param.Avatar == nil {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("avatar", "required", "required", strings.ToLower("Avatar")),
+		}
+	}
+	// validate size of file
+	if param.Avatar != nil && param.Avatar.Size > 5242880 {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("avatar", "maxsize", "maxsize", strings.ToLower("Avatar"), 5242880),
+		}
+	}
+	// validate mime type of file
+	mimeAvatar := strings.Split("image/png|image/jpeg", "|")
+	if param.Avatar != nil && !hasMimeType(param.Avatar, mimeAvatar) {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("avatar", "mimetype", "mimetype", strings.ToLower("Avatar"), strings.Join(mimeAvatar, ", ")),
+		}
+	}
+	return nil
+}
+
+func ValidateCreateParams(param *CreateParams) *ApiError {
 	// validate Login field
 	// validate required status
-	e = reflect.ValueOf(param).FieldByName("Login")
-	if reflect.Zero(e.Type()).Interface() == e.Interface() {
+	if param.Login == "" {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must me not empty", strings.ToLower("Login")),
+			Err:        newValidationError("login", "required", "required", strings.ToLower("Login")),
 		}
 	}
 	// validate min value
-	e = reflect.ValueOf(param).FieldByName("Login")
-	if len(e.Interface().(string)) < 10 {
+	if len(param.Login) < 10 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s len must be >= %d", strings.ToLower("Login"), 10),
+			Err:        newValidationError("login", "min", "min_len", strings.ToLower("Login"), 10),
 		}
 	}
 	// validate Name field
 	// validate Status field
 	// validate enum value
-	enumVal := strings.Split("user|moderator|admin", "|")
-	e = reflect.ValueOf(param).FieldByName("Status")
-	var findVal bool
-	for _, el := range enumVal {
-		if el == e.Interface().(string) {
-			findVal = true
+	if param.Status == "" {
+		param.Status = "user"
+	}
+	enumStatus := strings.Split("user|moderator|admin", "|")
+	var foundStatus bool
+	for _, el := range enumStatus {
+		if el == param.Status {
+			foundStatus = true
 			break
 		}
 	}
-	if !findVal && reflect.Zero(e.Type()).Interface() == e.Interface() {
-		param.Status = "user"
-		findVal = true
-	}
-	if !findVal {
+	if !foundStatus {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be one of [%v]", strings.ToLower("Status"), strings.Join(enumVal, ", ")),
+			Err:        newValidationError("status", "enum", "enum", strings.ToLower("Status"), strings.Join(enumStatus, ", ")),
 		}
 	}
 	// validate Age field
 	// validate min value
-	e = reflect.ValueOf(param).FieldByName("Age")
-	if e.Interface().(int) < 0 {
+	if param.Age < 0 {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("age", "min", "min", strings.ToLower("Age"), 0),
+		}
+	}
+	// validate max value
+	if param.Age > 128 {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        newValidationError("age", "max", "max", strings.ToLower("Age"), 128),
+		}
+	}
+	return nil
+}
+
+func ValidateExportParams(param *ExportParams) *ApiError {
+	// validate Limit field
+	// validate min value
+	if param.Limit < 0 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be >= %d", strings.ToLower("Age"), 0),
+			Err:        newValidationError("limit", "min", "min", strings.ToLower("Limit"), 0),
 		}
 	}
 	// validate max value
-	e = reflect.ValueOf(param).FieldByName("Age")
-	if e.Interface().(int) > 128 {
+	if param.Limit > 1000 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be <= %d", strings.ToLower("Age"), 128),
+			Err:        newValidationError("limit", "max", "max", strings.ToLower("Limit"), 1000),
 		}
 	}
 	return nil
 }
 
-func ValidateOtherCreateParams(param OtherCreateParams) *ApiError {
-	var e reflect.Value
+func ValidateOtherCreateParams(param *OtherCreateParams) *ApiError {
 	// validate Username field
 	// validate required status
-	e = reflect.ValueOf(param).FieldByName("Username")
-	if reflect.Zero(e.Type()).Interface() == e.Interface() {
+	if param.Username == "" {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must me not empty", strings.ToLower("Username")),
+			Err:        newValidationError("username", "required", "required", strings.ToLower("Username")),
 		}
 	}
 	// validate min value
-	e = reflect.ValueOf(param).FieldByName("Username")
-	if len(e.Interface().(string)) < 3 {
+	if len(param.Username) < 3 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s len must be >= %d", strings.ToLower("Username"), 3),
+			Err:        newValidationError("username", "min", "min_len", strings.ToLower("Username"), 3),
 		}
 	}
 	// validate Name field
 	// validate Class field
 	// validate enum value
-	enumVal := strings.Split("warrior|sorcerer|rouge", "|")
-	e = reflect.ValueOf(param).FieldByName("Class")
-	var findVal bool
-	for _, el := range enumVal {
-		if el == e.Interface().(string) {
-			findVal = true
+	if param.Class == "" {
+		param.Class = "warrior"
+	}
+	enumClass := strings.Split("warrior|sorcerer|rouge", "|")
+	var foundClass bool
+	for _, el := range enumClass {
+		if el == param.Class {
+			foundClass = true
 			break
 		}
 	}
-	if !findVal && reflect.Zero(e.Type()).Interface() == e.Interface() {
-		param.Class = "warrior"
-		findVal = true
-	}
-	if !findVal {
+	if !foundClass {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be one of [%v]", strings.ToLower("Class"), strings.Join(enumVal, ", ")),
+			Err:        newValidationError("class", "enum", "enum", strings.ToLower("Class"), strings.Join(enumClass, ", ")),
 		}
 	}
 	// validate Level field
 	// validate min value
-	e = reflect.ValueOf(param).FieldByName("Level")
-	if e.Interface().(int) < 1 {
+	if param.Level < 1 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be >= %d", strings.ToLower("Level"), 1),
+			Err:        newValidationError("level", "min", "min", strings.ToLower("Level"), 1),
 		}
 	}
 	// validate max value
-	e = reflect.ValueOf(param).FieldByName("Level")
-	if e.Interface().(int) > 50 {
+	if param.Level > 50 {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must be <= %d", strings.ToLower("Level"), 50),
+			Err:        newValidationError("level", "max", "max", strings.ToLower("Level"), 50),
 		}
 	}
 	return nil
 }
 
-func ValidateProfileParams(param ProfileParams) *ApiError {
-	var e reflect.Value
+func ValidateProfileParams(param *ProfileParams) *ApiError {
 	// validate Login field
 	// validate required status
-	e = reflect.ValueOf(param).FieldByName("Login")
-	if reflect.Zero(e.Type()).Interface() == e.Interface() {
+	if param.Login == "" {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err:        fmt.Errorf("%s must me not empty", strings.ToLower("Login")),
+			Err:        newValidationError("login", "required", "required", strings.ToLower("Login")),
 		}
 	}
 	return nil
 }
+
+// rateLimiter is an in-process token bucket per client key
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// allow takes a token of key, if there is none it returns how long to wait for it
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.buckets) > 10000 {
+		// forget clients whose buckets are full again
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateKeyIP identifies clients of rate limited endpoints by address
+func rateKeyIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateKeyAuth identifies clients of rate limited endpoints by auth token,
+// endpoints check it before, so that fake tokens do not get buckets
+func rateKeyAuth(r *http.Request) string {
+	return r.Header.Get("X-Auth")
+}
+
+// apigenCall tracks a call of an endpoint for metrics and access log
+type apigenCall struct {
+	http.ResponseWriter
+	metrics   *apigenMetrics
+	logger    *log.Logger
+	endpoint  string
+	method    string
+	requestID string
+	principal string
+	status    int
+	result    string
+	field     string
+	rule      string
+	start     time.Time
+}
+
+type apigenCallKey struct{}
+
+// Unwrap lets http.ResponseController flush streams through the call
+func (c *apigenCall) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *apigenCall) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *apigenCall) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *apigenCall) end() {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.result == "" {
+		c.result = "ok"
+		if c.status >= 400 {
+			c.result = "rejected"
+		}
+	}
+	c.metrics.end(c)
+	if c.logger != nil {
+		c.writeLog()
+	}
+}
+
+// setResult tells metrics how the call of the endpoint ended up:
+// ok, rejected, invalid (params), error (of the method) or panic
+func setResult(r *http.Request, result string) {
+	if c, ok := r.Context().Value(apigenCallKey{}).(*apigenCall); ok {
+		c.result = result
+	}
+}
+
+var apigenLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type apigenRequestsKey struct {
+	endpoint string
+	status   int
+	result   string
+}
+
+type apigenHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// apigenMetrics are metrics of endpoints of a receiver
+type apigenMetrics struct {
+	receiver   string
+	mu         sync.Mutex
+	requests   map[apigenRequestsKey]uint64
+	latency    map[string]*apigenHistogram
+	inFlight   map[string]int64
+	deprecated map[string]uint64
+}
+
+func newApigenMetrics(receiver string) *apigenMetrics {
+	return &apigenMetrics{
+		receiver:   receiver,
+		requests:   make(map[apigenRequestsKey]uint64),
+		latency:    make(map[string]*apigenHistogram),
+		inFlight:   make(map[string]int64),
+		deprecated: make(map[string]uint64),
+	}
+}
+
+func (m *apigenMetrics) begin(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[endpoint]++
+}
+
+// deprecatedCall counts a call of a deprecated endpoint
+func (m *apigenMetrics) deprecatedCall(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deprecated[endpoint]++
+}
+
+func (m *apigenMetrics) end(c *apigenCall) {
+	elapsed := time.Since(c.start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[c.endpoint]--
+	m.requests[apigenRequestsKey{c.endpoint, c.status, c.result}]++
+	hist, ok := m.latency[c.endpoint]
+	if !ok {
+		hist = &apigenHistogram{buckets: make([]uint64, len(apigenLatencyBuckets))}
+		m.latency[c.endpoint] = hist
+	}
+	for ix, le := range apigenLatencyBuckets {
+		if elapsed <= le {
+			hist.buckets[ix]++
+		}
+	}
+	hist.sum += elapsed
+	hist.count++
+}
+
+var apigenLabelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// ServeHTTP writes the metrics in prometheus text exposition format
+func (m *apigenMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rcv := apigenLabelEscaper.Replace(m.receiver)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]apigenRequestsKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		if keys[i].status != keys[j].status {
+			return keys[i].status < keys[j].status
+		}
+		return keys[i].result < keys[j].result
+	})
+	fmt.Fprintln(w, "# HELP apigen_requests_total Requests by endpoint, status and result.")
+	fmt.Fprintln(w, "# TYPE apigen_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "apigen_requests_total{receiver=\"%s\",endpoint=\"%s\",status=\"%d\",result=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(k.endpoint), k.status, k.result, m.requests[k])
+	}
+
+	endpoints := make([]string, 0, len(m.latency))
+	for e := range m.latency {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_request_duration_seconds Latency of requests by endpoint.")
+	fmt.Fprintln(w, "# TYPE apigen_request_duration_seconds histogram")
+	for _, e := range endpoints {
+		hist := m.latency[e]
+		ep := apigenLabelEscaper.Replace(e)
+		for ix, le := range apigenLatencyBuckets {
+			fmt.Fprintf(w, "apigen_request_duration_seconds_bucket{receiver=\"%s\",endpoint=\"%s\",le=\"%s\"} %d\n",
+				rcv, ep, strconv.FormatFloat(le, 'g', -1, 64), hist.buckets[ix])
+		}
+		fmt.Fprintf(w, "apigen_request_duration_seconds_bucket{receiver=\"%s\",endpoint=\"%s\",le=\"+Inf\"} %d\n", rcv, ep, hist.count)
+		fmt.Fprintf(w, "apigen_request_duration_seconds_sum{receiver=\"%s\",endpoint=\"%s\"} %s\n",
+			rcv, ep, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "apigen_request_duration_seconds_count{receiver=\"%s\",endpoint=\"%s\"} %d\n", rcv, ep, hist.count)
+	}
+
+	endpoints = endpoints[:0]
+	for e := range m.inFlight {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_requests_in_flight Requests being served by endpoint.")
+	fmt.Fprintln(w, "# TYPE apigen_requests_in_flight gauge")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "apigen_requests_in_flight{receiver=\"%s\",endpoint=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(e), m.inFlight[e])
+	}
+
+	endpoints = endpoints[:0]
+	for e := range m.deprecated {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_deprecated_requests_total Requests to deprecated endpoints.")
+	fmt.Fprintln(w, "# TYPE apigen_deprecated_requests_total counter")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "apigen_deprecated_requests_total{receiver=\"%s\",endpoint=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(e), m.deprecated[e])
+	}
+}
+
+// ValidationError is the reason params of a request are rejected
+type ValidationError struct {
+	Field   string
+	Rule    string
+	Message string
+	// Key and Args make the message in other languages, see ValidationMessages
+	Key  string
+	Args []interface{}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the X-Request-Id of the request served with ctx
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID generates an id for requests which come without X-Request-Id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of clients which are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// beginCall starts tracking of a call of endpoint, the returned request
+// carries the call and the request id in its context
+func beginCall(w http.ResponseWriter, r *http.Request, endpoint string, m *apigenMetrics, logger *log.Logger) (*apigenCall, *http.Request) {
+	m.begin(endpoint)
+	id := r.Header.Get("X-Request-Id")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-Id", id)
+	c := &apigenCall{
+		ResponseWriter: w,
+		metrics:        m,
+		logger:         logger,
+		endpoint:       endpoint,
+		method:         r.Method,
+		requestID:      id,
+		start:          time.Now(),
+	}
+	if token := r.Header.Get("X-Auth"); token != "" {
+		// the token itself must not get into logs
+		sum := sha256.Sum256([]byte(token))
+		c.principal = "token:" + hex.EncodeToString(sum[:4])
+	}
+	ctx := context.WithValue(r.Context(), apigenCallKey{}, c)
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return c, r.WithContext(ctx)
+}
+
+// setInvalid marks the call as rejected because of its params
+func setInvalid(r *http.Request, err *ApiError) {
+	c, ok := r.Context().Value(apigenCallKey{}).(*apigenCall)
+	if !ok {
+		return
+	}
+	c.result = "invalid"
+	if ve, ok := err.Err.(*ValidationError); ok {
+		c.field = ve.Field
+		c.rule = ve.Rule
+	}
+}
+
+type apigenLogLine struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Receiver   string  `json:"receiver"`
+	Endpoint   string  `json:"endpoint"`
+	Method     string  `json:"method"`
+	Status     int     `json:"status"`
+	Result     string  `json:"result"`
+	DurationMs float64 `json:"duration_ms"`
+	Principal  string  `json:"principal,omitempty"`
+	Field      string  `json:"field,omitempty"`
+	Rule       string  `json:"rule,omitempty"`
+}
+
+func (c *apigenCall) writeLog() {
+	line, _ := json.Marshal(apigenLogLine{
+		Time:       c.start.UTC().Format(time.RFC3339Nano),
+		RequestID:  c.requestID,
+		Receiver:   c.metrics.receiver,
+		Endpoint:   c.endpoint,
+		Method:     c.method,
+		Status:     c.status,
+		Result:     c.result,
+		DurationMs: float64(time.Since(c.start).Microseconds()) / 1000,
+		Principal:  c.principal,
+		Field:      c.field,
+		Rule:       c.rule,
+	})
+	c.logger.Println(string(line))
+}
+
+// etagOf is a strong ETag of a response body
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// etagMatch reports if If-None-Match of a request matches etag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, el := range strings.Split(ifNoneMatch, ",") {
+		el = strings.TrimPrefix(strings.TrimSpace(el), "W/")
+		if el == "*" || el == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// IdempotentResponse is the first response to a request with an Idempotency-Key
+type IdempotentResponse struct {
+	// Fingerprint identifies params of the request and formats it accepts,
+	// a repeat must have the same
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore keeps responses of idempotent endpoints, implementations
+// must be safe for concurrent use and forget responses after ttl
+type IdempotencyStore interface {
+	Get(key string) (*IdempotentResponse, bool)
+	Put(key string, resp *IdempotentResponse, ttl time.Duration)
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore keeping at most
+// MaxItems responses, the oldest ones are forgotten first. 0 is no limit.
+type MemoryIdempotencyStore struct {
+	MaxItems int
+	mu       sync.Mutex
+	items    map[string]memoryIdempotencyItem
+	// order are keys by the time they are put, a key put again is in it twice
+	order []memoryIdempotencyKey
+}
+
+type memoryIdempotencyItem struct {
+	resp    *IdempotentResponse
+	expires time.Time
+}
+
+type memoryIdempotencyKey struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{MaxItems: 10000, items: make(map[string]memoryIdempotencyItem)}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (*IdempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(item.expires) {
+		delete(s.items, key)
+		return nil, false
+	}
+	return item.resp, true
+}
+
+func (s *MemoryIdempotencyStore) Put(key string, resp *IdempotentResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	_, replaced := s.items[key]
+	full := func() bool {
+		return s.MaxItems > 0 && !replaced && len(s.items) >= s.MaxItems
+	}
+	// with the same ttl the oldest responses expire first
+	for len(s.order) > 0 && (now.After(s.order[0].expires) || full()) {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		if item, ok := s.items[oldest.key]; ok && item.expires.Equal(oldest.expires) {
+			delete(s.items, oldest.key)
+		}
+	}
+	expires := now.Add(ttl)
+	s.items[key] = memoryIdempotencyItem{resp: resp, expires: expires}
+	s.order = append(s.order, memoryIdempotencyKey{key: key, expires: expires})
+}
+
+// apigenIdempotency serializes requests with the same Idempotency-Key
+type apigenIdempotency struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func newApigenIdempotency() *apigenIdempotency {
+	return &apigenIdempotency{inFlight: make(map[string]bool)}
+}
+
+// idempotentWriter records the response to store it once the handler is done
+type idempotentWriter struct {
+	http.ResponseWriter
+	idem        *apigenIdempotency
+	store       IdempotencyStore
+	ttl         time.Duration
+	key         string
+	fingerprint string
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *idempotentWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// finish stores the response, internal errors are not stored so that
+// the request can be retried
+func (w *idempotentWriter) finish() {
+	if w.status != 0 && w.status < 500 {
+		w.store.Put(w.key, &IdempotentResponse{
+			Fingerprint: w.fingerprint,
+			Status:      w.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		}, w.ttl)
+	}
+	w.idem.mu.Lock()
+	delete(w.idem.inFlight, w.key)
+	w.idem.mu.Unlock()
+}
+
+// begin handles the Idempotency-Key of a request to endpoint. It either answers
+// the request itself, replaying the stored response or rejecting the key, or
+// returns the writer to serve the request with.
+func (idem *apigenIdempotency) begin(w http.ResponseWriter, r *http.Request, store IdempotencyStore, ttl time.Duration, endpoint, key string) (*idempotentWriter, bool) {
+	if len(key) > 255 {
+		writeError(w, r, http.StatusBadRequest, "idempotency_key_too_long", "idempotency key is too long")
+		return nil, true
+	}
+	r.ParseForm()
+	// the stored body is replayed as is, so a repeat must get it in the same format
+	errFormat, _ := negotiate(r.Header.Get("Accept"), false)
+	format, _ := negotiate(r.Header.Get("Accept"), true)
+	sum := sha256.Sum256([]byte(r.Method + "\n" + errFormat + "\n" + format + "\n" + r.Form.Encode()))
+	fingerprint := hex.EncodeToString(sum[:])
+	// keys of different clients must not clash
+	auth := sha256.Sum256([]byte(r.Header.Get("X-Auth")))
+	key = endpoint + "\n" + hex.EncodeToString(auth[:8]) + "\n" + key
+
+	idem.mu.Lock()
+	if idem.inFlight[key] {
+		idem.mu.Unlock()
+		writeError(w, r, http.StatusConflict, "idempotency_in_progress", "request with this idempotency key is in progress")
+		return nil, true
+	}
+	if stored, ok := store.Get(key); ok {
+		idem.mu.Unlock()
+		if stored.Fingerprint != fingerprint {
+			writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", "idempotency key is reused with different params")
+			return nil, true
+		}
+		setResult(r, "replayed")
+		w.Header().Set("Content-Type", stored.ContentType)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return nil, true
+	}
+	idem.inFlight[key] = true
+	idem.mu.Unlock()
+	return &idempotentWriter{
+		ResponseWriter: w,
+		idem:           idem,
+		store:          store,
+		ttl:            ttl,
+		key:            key,
+		fingerprint:    fingerprint,
+	}, false
+}
+
+// CORSPolicy tells browsers on which origins may call endpoints
+type CORSPolicy struct {
+	// AllowOrigins are allowed origins like https://app.example.com, * allows any
+	AllowOrigins []string
+	// AllowMethods default to the methods of the endpoint
+	AllowMethods []string
+	AllowHeaders []string
+	// ExposeHeaders are response headers scripts may read, nil exposes
+	// DefaultExposeHeaders
+	ExposeHeaders    []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight answer
+	MaxAge time.Duration
+}
+
+// DefaultExposeHeaders are the headers generated handlers answer with,
+// besides ones browsers expose anyway
+var DefaultExposeHeaders = []string{"X-Request-Id", "ETag", "Retry-After", "Deprecation", "Sunset", "Link", "Idempotent-Replayed"}
+
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	for _, o := range p.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, a := range p.AllowHeaders {
+			if strings.EqualFold(a, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serveCORS adds CORS headers of policy to the response, it answers OPTIONS
+// requests itself and reports that they are done. Endpoint accepts methods.
+func serveCORS(w http.ResponseWriter, r *http.Request, policy *CORSPolicy, methods []string) bool {
+	allowed := methods
+	if policy != nil && len(policy.AllowMethods) > 0 {
+		allowed = policy.AllowMethods
+	}
+	origin := r.Header.Get("Origin")
+	corsOK := false
+	if policy != nil && !policy.AllowCredentials && policy.allowOrigin("*") {
+		// the answer is the same with any origin or none, caches may share it
+		corsOK = true
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if policy != nil {
+		// caches must not give the answer to one origin to another
+		w.Header().Add("Vary", "Origin")
+		corsOK = origin != "" && policy.allowOrigin(origin)
+		if corsOK {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if policy.AllowCredentials {
+				// browsers do not send credentials to *
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+	}
+	if r.Method != http.MethodOptions {
+		expose := DefaultExposeHeaders
+		if policy != nil && policy.ExposeHeaders != nil {
+			expose = policy.ExposeHeaders
+		}
+		if corsOK && len(expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		}
+		return false
+	}
+
+	w.Header().Set("Allow", strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", "))
+	reqMethod := r.Header.Get("Access-Control-Request-Method")
+	if corsOK && reqMethod != "" {
+		methodOK := false
+		for _, m := range allowed {
+			if m == reqMethod {
+				methodOK = true
+				break
+			}
+		}
+		if methodOK && policy.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+			if len(policy.AllowHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowHeaders, ", "))
+			}
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge/time.Second)))
+			}
+		} else {
+			// the browser fails the preflight without allow headers
+			w.Header().Del("Access-Control-Allow-Origin")
+			w.Header().Del("Access-Control-Allow-Credentials")
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// splitVersion cuts one of versions off the path, /v2/user/create gives /v2 and /user/create
+func splitVersion(path string, versions []string) (string, string) {
+	for _, v := range versions {
+		if strings.HasPrefix(path, "/"+v+"/") {
+			return "/" + v, path[len(v)+1:]
+		}
+	}
+	return "", path
+}
+
+// setDeprecated tells clients that the endpoint is going away
+func setDeprecated(w http.ResponseWriter, sunset, replacement string) {
+	w.Header().Set("Deprecation", "true")
+	if sunset != "" {
+		w.Header().Set("Sunset", sunset)
+	}
+	if replacement != "" {
+		w.Header().Add("Link", "<"+replacement+">; rel=\"successor-version\"")
+	}
+}
+
+type batchRequest struct {
+	Method string                 `json:"method"`
+	Url    string                 `json:"url"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type batchResponse struct {
+	Status int         `json:"status"`
+	Body   interface{} `json:"body"`
+}
+
+// batchRecorder keeps the response to a request of a batch
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *batchRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// batchValues converts params of a request of a batch to form values
+func batchValues(params map[string]interface{}) (url.Values, error) {
+	v := url.Values{}
+	for k, el := range params {
+		switch val := el.(type) {
+		case nil:
+		case string:
+			v.Set(k, val)
+		case json.Number:
+			v.Set(k, val.String())
+		case bool:
+			v.Set(k, strconv.FormatBool(val))
+		default:
+			return nil, fmt.Errorf("param %s must be a string, number or bool", k)
+		}
+	}
+	return v, nil
+}
+
+// serveBatch runs requests of a batch with dispatch, at most concurrency of them at once.
+// The requests get headers of the batch request. A body over maxBody bytes is
+// answered with 413, 0 is no limit.
+func serveBatch(w http.ResponseWriter, r *http.Request, maxBatch, concurrency int, maxBody int64, dispatch func(http.ResponseWriter, *http.Request)) {
+	fail := func(status int, code, msg string) {
+		res := map[string]string{"error": msg, "code": code}
+		body, _ := json.Marshal(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+	if r.Method != http.MethodPost {
+		fail(http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	reqs := []batchRequest{}
+	if err := dec.Decode(&reqs); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+			return
+		}
+		fail(http.StatusBadRequest, "bad_batch", "batch must be an array of {method, url, params}")
+		return
+	}
+	if maxBatch > 0 && len(reqs) > maxBatch {
+		fail(http.StatusBadRequest, "batch_too_large", fmt.Sprintf("batch must have at most %d requests", maxBatch))
+		return
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]batchResponse, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for ix, el := range reqs {
+		// requests start in order, one by one if concurrency is 1
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(ix int, el batchRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			values, err := batchValues(el.Params)
+			if err != nil {
+				results[ix] = batchResponse{Status: http.StatusBadRequest, Body: map[string]string{"error": err.Error(), "code": "bad_params"}}
+				return
+			}
+			method := el.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+			var sub *http.Request
+			if method == http.MethodGet {
+				sub, err = http.NewRequestWithContext(r.Context(), method, el.Url, nil)
+				if err == nil && len(values) > 0 {
+					sub.URL.RawQuery = values.Encode()
+				}
+			} else {
+				sub, err = http.NewRequestWithContext(r.Context(), method, el.Url, strings.NewReader(values.Encode()))
+			}
+			if err != nil {
+				results[ix] = batchResponse{Status: http.StatusBadRequest, Body: map[string]string{"error": "bad url", "code": "bad_url"}}
+				return
+			}
+			for k, vv := range r.Header {
+				switch k {
+				case "Content-Type", "Content-Length", "Idempotency-Key", "If-None-Match", "Accept":
+					// they belong to the batch request itself
+				default:
+					sub.Header[k] = vv
+				}
+			}
+			if method != http.MethodGet {
+				sub.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			sub.RemoteAddr = r.RemoteAddr
+
+			rec := &batchRecorder{header: make(http.Header)}
+			dispatch(rec, sub)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			res := batchResponse{Status: rec.status}
+			if body := rec.body.Bytes(); json.Valid(body) {
+				res.Body = json.RawMessage(body)
+			} else if len(body) > 0 {
+				res.Body = string(body)
+			}
+			results[ix] = res
+		}(ix, el)
+	}
+	wg.Wait()
+	body, _ := json.Marshal(results)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// apigenStream writes items of a stream endpoint as ndjson lines or server-sent events
+type apigenStream struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	rc      *http.ResponseController
+	format  string
+	started bool
+}
+
+func newApigenStream(w http.ResponseWriter, r *http.Request, format string) *apigenStream {
+	return &apigenStream{w: w, r: r, rc: http.NewResponseController(w), format: format}
+}
+
+func (s *apigenStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	if s.format == "sse" {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// send writes and flushes an item, it fails once the client is gone
+func (s *apigenStream) send(item interface{}) error {
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	s.start()
+	var err error
+	if s.format == "sse" {
+		data, _ := json.Marshal(item)
+		_, err = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	} else {
+		data, _ := json.Marshal(map[string]interface{}{
+			"error":    "",
+			"response": item,
+		})
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// end finishes the stream, an error before the first item is answered like in
+// other endpoints, a later one goes as the final line or error event
+func (s *apigenStream) end(err error) {
+	if err == nil {
+		s.start()
+		return
+	}
+	if s.r.Context().Err() != nil {
+		// nobody listens any more
+		setResult(s.r, "canceled")
+		return
+	}
+	setResult(s.r, "error")
+	if !s.started {
+		writeApiError(s.w, s.r, err)
+		return
+	}
+	info := errorInfoOf(err, messageLanguage(s.r.Header.Get("Accept-Language")))
+	data, _ := json.Marshal(jsonError{Error: info.Message, Code: info.Code, Details: info.Details})
+	if s.format == "sse" {
+		fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprintf(s.w, "%s\n", data)
+	}
+	s.rc.Flush()
+}
+
+// FillFile reads a file of a multipart/form-data request into *multipart.FileHeader
+// or []byte, a missing file is nil
+func FillFile(n, t string, r *http.Request) (interface{}, *ApiError) {
+	n = strings.ToLower(n)
+	bad := &ApiError{
+		HTTPStatus: http.StatusBadRequest,
+		Err:        newValidationError(n, "type", "type", n, "file"),
+	}
+	file, header, err := r.FormFile(n)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		if t == "[]byte" {
+			return []byte(nil), nil
+		}
+		return (*multipart.FileHeader)(nil), nil
+	}
+	if err != nil {
+		return nil, bad
+	}
+	defer file.Close()
+	if t != "[]byte" {
+		return header, nil
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, bad
+	}
+	return data, nil
+}
+
+// hasMimeType tells if the content of a file sniffs as one of types
+func hasMimeType(file interface{}, types []string) bool {
+	var head []byte
+	switch f := file.(type) {
+	case []byte:
+		head = f
+	case *multipart.FileHeader:
+		r, err := f.Open()
+		if err != nil {
+			return false
+		}
+		defer r.Close()
+		head = make([]byte, 512)
+		n, _ := io.ReadFull(r, head)
+		head = head[:n]
+	}
+	mimeType := http.DetectContentType(head)
+	if ix := strings.Index(mimeType, ";"); ix >= 0 {
+		mimeType = mimeType[:ix]
+	}
+	for _, t := range types {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// readForm parses the query and the body of a request, a body over
+// http.MaxBytesReader limit is answered with 413
+func readForm(r *http.Request) *ApiError {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(32 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+	if err == nil {
+		return nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &ApiError{
+			HTTPStatus: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("request body must be at most %d bytes", tooLarge.Limit),
+			Code:       "body_too_large",
+		}
+	}
+	return &ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("bad request body"), Code: "bad_body"}
+}
+
+// checkParams rejects params of a request other than known ones
+func checkParams(r *http.Request, known ...string) *ApiError {
+	names := make([]string, 0, len(r.Form))
+	for k := range r.Form {
+		names = append(names, k)
+	}
+	if r.MultipartForm != nil {
+		for k := range r.MultipartForm.File {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		found := false
+		for _, k := range known {
+			if k == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError(name, "unknown", "unknown", name),
+			}
+		}
+	}
+	return nil
+}
+
+// ValidationMessages are formats of validation messages by language and key,
+// the args of a ValidationError go into them. en is the default language,
+// a key missing in another language falls back to it.
+var ValidationMessages = map[string]map[string]string{
+	"en": {
+		"required": "%s must me not empty",
+		"min":      "%s must be >= %d",
+		"min_len":  "%s len must be >= %d",
+		"max":      "%s must be <= %d",
+		"max_len":  "%s len must be <= %d",
+		"enum":     "%s must be one of [%v]",
+		"type":     "%s must be %s",
+		"maxsize":  "%s size must be <= %d bytes",
+		"mimetype": "%s must be one of [%v]",
+		"unknown":  "unknown param %s",
+	},
+	"ru": {
+		"required": "параметр %s не должен быть пустым",
+		"min":      "параметр %s должен быть >= %d",
+		"min_len":  "длина параметра %s должна быть >= %d",
+		"max":      "параметр %s должен быть <= %d",
+		"max_len":  "длина параметра %s должна быть <= %d",
+		"enum":     "параметр %s должен быть одним из [%v]",
+		"type":     "параметр %s должен быть типа %s",
+		"maxsize":  "размер файла %s должен быть <= %d байт",
+		"mimetype": "файл %s должен быть одного из типов [%v]",
+		"unknown":  "неизвестный параметр %s",
+	},
+}
+
+func newValidationError(field, rule, key string, args ...interface{}) *ValidationError {
+	e := &ValidationError{Field: field, Rule: rule, Key: key, Args: args}
+	e.Message = e.Localize("en")
+	return e
+}
+
+// Localize makes the message of the error in lang
+func (e *ValidationError) Localize(lang string) string {
+	format, ok := ValidationMessages[lang][e.Key]
+	if !ok {
+		format, ok = ValidationMessages["en"][e.Key]
+	}
+	if !ok {
+		return e.Message
+	}
+	return fmt.Sprintf(format, e.Args...)
+}
+
+// messageLanguage picks the language of messages by Accept-Language, en if none fits
+func messageLanguage(acceptLanguage string) string {
+	best, bestQ := "en", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// ru-RU is ru
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if ix := strings.Index(lang, "-"); ix >= 0 {
+			lang = lang[:ix]
+		}
+		if _, ok := ValidationMessages[lang]; ok && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// errorInfo is what an error response tells about the error
+type errorInfo struct {
+	Status  int
+	Message string
+	Code    string
+	Details map[string]interface{}
+}
+
+// errorInfoOf reads the status, code and details of an error. Validation errors
+// get validation.<rule> codes, the field in details and the message in lang,
+// errors other than ApiError are internal ones.
+func errorInfoOf(err error, lang string) errorInfo {
+	apiErr, ok := err.(ApiError)
+	if e, isPtr := err.(*ApiError); isPtr {
+		apiErr, ok = *e, true
+	}
+	if !ok {
+		return errorInfo{Status: http.StatusInternalServerError, Message: err.Error()}
+	}
+	info := errorInfo{Status: apiErr.HTTPStatus, Message: apiErr.Error(), Code: apiErr.Code}
+	if vErr, isValidation := apiErr.Err.(*ValidationError); isValidation {
+		if info.Code == "" {
+			info.Code = "validation." + vErr.Rule
+			info.Message = vErr.Localize(lang)
+		}
+		info.Details = map[string]interface{}{"field": vErr.Field}
+	}
+	for k, v := range apiErr.Details {
+		if info.Details == nil {
+			info.Details = make(map[string]interface{})
+		}
+		info.Details[k] = v
+	}
+	return info
+}
+
+// jsonError is the envelope of errors in json
+type jsonError struct {
+	Error   string                 `json:"error"`
+	Code    string                 `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// xmlEnvelope is the envelope of responses in xml, the response keeps xml tags of its type
+type xmlEnvelope struct {
+	XMLName  xml.Name    `xml:"envelope"`
+	Error    string      `xml:"error"`
+	Code     string      `xml:"code,omitempty"`
+	Details  *xmlDetails `xml:"details,omitempty"`
+	Response interface{} `xml:"response,omitempty"`
+}
+
+type xmlDetails struct {
+	Detail []xmlDetail `xml:"detail"`
+}
+
+type xmlDetail struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// negotiate picks the format of a response by Accept: json, xml or text.
+// text is a format of errors only, it is not picked for a success.
+// ok is false if no format is acceptable.
+func negotiate(accept string, success bool) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "json", true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		format := ""
+		switch strings.ToLower(strings.TrimSpace(fields[0])) {
+		case "application/json", "application/*", "*/*":
+			format = "json"
+		case "application/xml", "text/xml":
+			format = "xml"
+		case "text/plain", "text/*":
+			if !success {
+				format = "text"
+			}
+		}
+		if format != "" && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, best != ""
+}
+
+// encodeEnvelope encodes the envelope of a response, of an error if e is not nil
+func encodeEnvelope(format string, e *errorInfo, response interface{}) ([]byte, string) {
+	switch format {
+	case "xml":
+		env := xmlEnvelope{}
+		if e == nil {
+			env.Response = response
+		} else {
+			env.Error, env.Code = e.Message, e.Code
+			keys := make([]string, 0, len(e.Details))
+			for k := range e.Details {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if len(keys) > 0 {
+				env.Details = &xmlDetails{}
+			}
+			for _, k := range keys {
+				env.Details.Detail = append(env.Details.Detail, xmlDetail{Name: k, Value: fmt.Sprint(e.Details[k])})
+			}
+		}
+		body, err := xml.Marshal(env)
+		if err != nil {
+			body, _ = xml.Marshal(xmlEnvelope{Error: "can not encode response"})
+		}
+		return append([]byte(xml.Header), body...), "application/xml"
+	case "text":
+		if e != nil {
+			return []byte(e.Message + "\n"), "text/plain; charset=utf-8"
+		}
+	}
+	if e != nil {
+		body, _ := json.Marshal(jsonError{Error: e.Message, Code: e.Code, Details: e.Details})
+		return body, "application/json"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"error":    "",
+		"response": response,
+	})
+	return body, "application/json"
+}
+
+// encodeResponse encodes the successful response in the format the request accepts,
+// handlers answer 406 before calling the service if there is none
+func encodeResponse(r *http.Request, response interface{}) ([]byte, string) {
+	format, _ := negotiate(r.Header.Get("Accept"), true)
+	return encodeEnvelope(format, nil, response)
+}
+
+// writeError answers with an error and its stable code in the format the request
+// accepts, json if none
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, errMsg string) {
+	writeErrorInfo(w, r, errorInfo{Status: status, Message: errMsg, Code: code})
+}
+
+// writeApiError answers with err along with its code and details
+func writeApiError(w http.ResponseWriter, r *http.Request, err error) {
+	writeErrorInfo(w, r, errorInfoOf(err, messageLanguage(r.Header.Get("Accept-Language"))))
+}
+
+func writeErrorInfo(w http.ResponseWriter, r *http.Request, e errorInfo) {
+	format, _ := negotiate(r.Header.Get("Accept"), false)
+	body, contentType := encodeEnvelope(format, &e, nil)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+)
+
+type jsonrpcRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcMethod func(r *http.Request, params json.RawMessage) (interface{}, error)
+
+// JSONRPCHandler serves endpoints of all receivers as JSON-RPC 2.0 methods
+// named like MyApi.Create. Params are an object keyed by param names, they are
+// validated like the ones of http endpoints. Auth and rate limits apply,
+// http methods, middlewares and caching do not.
+type JSONRPCHandler struct {
+	// MaxBatch is the most requests a batch may have
+	MaxBatch int
+	// MaxBody is the most bytes a request body may have, 0 is no limit.
+	// It defaults to the largest max_body of the methods, params of a call
+	// are also limited by max_body of its method.
+	MaxBody int64
+	methods map[string]jsonrpcMethod
+}
+
+func NewJSONRPCHandler(myApi *MyApiHandler, otherApi *OtherApiHandler) *JSONRPCHandler {
+	return &JSONRPCHandler{
+		MaxBatch: 100,
+		MaxBody:  1048576,
+		methods: map[string]jsonrpcMethod{
+			"MyApi.Profile":   myApi.rpcProfile,
+			"MyApi.ProfileV2": myApi.rpcProfileV2,
+			"MyApi.Create":    myApi.rpcCreate,
+			"OtherApi.Create": otherApi.rpcCreate,
+		},
+	}
+}
+
+func (h *JSONRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.write(w, http.StatusMethodNotAllowed, jsonrpcFail(nil, jsonrpcInvalidRequest, "only POST is allowed", nil))
+		return
+	}
+	if h.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBody)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			msg := fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit)
+			h.write(w, http.StatusRequestEntityTooLarge, jsonrpcFail(nil, jsonrpcInvalidRequest, msg, nil))
+			return
+		}
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcParseError, "parse error", nil))
+		return
+	}
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		res := h.call(r, raw)
+		if res == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.write(w, http.StatusOK, res)
+		return
+	}
+
+	batch := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcParseError, "parse error", nil))
+		return
+	}
+	if len(batch) == 0 {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcInvalidRequest, "empty batch", nil))
+		return
+	}
+	if h.MaxBatch > 0 && len(batch) > h.MaxBatch {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcInvalidRequest, fmt.Sprintf("batch must have at most %d requests", h.MaxBatch), nil))
+		return
+	}
+	results := make([]*jsonrpcResponse, len(batch))
+	wg := &sync.WaitGroup{}
+	for ix, req := range batch {
+		wg.Add(1)
+		go func(ix int, req json.RawMessage) {
+			defer wg.Done()
+			results[ix] = h.call(r, req)
+		}(ix, req)
+	}
+	wg.Wait()
+	res := make([]*jsonrpcResponse, 0, len(results))
+	for _, el := range results {
+		// notifications get no response
+		if el != nil {
+			res = append(res, el)
+		}
+	}
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.write(w, http.StatusOK, res)
+}
+
+func (h *JSONRPCHandler) write(w http.ResponseWriter, status int, res interface{}) {
+	body, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// call runs a single request, it returns nil for notifications
+func (h *JSONRPCHandler) call(r *http.Request, raw json.RawMessage) (res *jsonrpcResponse) {
+	req := jsonrpcRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil || req.Jsonrpc != "2.0" || req.Method == "" {
+		return jsonrpcFail(nil, jsonrpcInvalidRequest, "invalid request", nil)
+	}
+	notification := len(req.ID) == 0
+	defer func() {
+		if notification {
+			res = nil
+		}
+	}()
+	method, ok := h.methods[req.Method]
+	if !ok {
+		return jsonrpcFail(req.ID, jsonrpcMethodNotFound, "method not found", nil)
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("%s panic: %v\n%s", req.Method, rec, debug.Stack())
+			res = jsonrpcFail(req.ID, jsonrpcInternalError, "internal error", nil)
+		}
+	}()
+	answer, err := method(r, req.Params)
+	if err != nil {
+		return jsonrpcFailWith(req.ID, err, messageLanguage(r.Header.Get("Accept-Language")))
+	}
+	return &jsonrpcResponse{Jsonrpc: "2.0", Result: answer, ID: req.ID}
+}
+
+func jsonrpcFail(id json.RawMessage, code int, msg string, data interface{}) *jsonrpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		Jsonrpc: "2.0",
+		Error:   &jsonrpcError{Code: code, Message: msg, Data: data},
+		ID:      id,
+	}
+}
+
+// jsonrpcFailWith maps the http status of an error to a JSON-RPC code,
+// the status itself, the code and details of the error go to data
+func jsonrpcFailWith(id json.RawMessage, err error, lang string) *jsonrpcResponse {
+	info := errorInfoOf(err, lang)
+	data := map[string]interface{}{"status": info.Status}
+	if info.Code != "" {
+		data["code"] = info.Code
+	}
+	for k, v := range info.Details {
+		data[k] = v
+	}
+	apiErr, ok := err.(ApiError)
+	if e, isPtr := err.(*ApiError); isPtr {
+		apiErr, ok = *e, true
+	}
+	if vErr, isValidation := apiErr.Err.(*ValidationError); ok && isValidation {
+		data["rule"] = vErr.Rule
+	}
+	code := jsonrpcServerError
+	switch {
+	case info.Status == http.StatusBadRequest:
+		code = jsonrpcInvalidParams
+	case info.Status >= 500:
+		code = jsonrpcInternalError
+	}
+	return jsonrpcFail(id, code, info.Message, data)
+}
+
+func (h *MyApiHandler) rpcProfile(r *http.Request, params json.RawMessage) (interface{}, error) {
+	raw := map[string]json.RawMessage{}
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("params must be an object"), Code: "bad_params"}
+		}
+	}
+	in := ProfileParams{}
+	if v, ok := raw["login"]; ok {
+		if err := json.Unmarshal(v, &in.Login); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("login", "type", "type", "login", "string"),
+			}
+		}
+	}
+	if err := ValidateProfileParams(&in); err != nil {
+		return nil, err
+	}
+	return h.Service.Profile(r.Context(), in)
+}
+
+func (h *MyApiHandler) rpcProfileV2(r *http.Request, params json.RawMessage) (interface{}, error) {
+	raw := map[string]json.RawMessage{}
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("params must be an object"), Code: "bad_params"}
+		}
+	}
+	in := ProfileParams{}
+	if v, ok := raw["login"]; ok {
+		if err := json.Unmarshal(v, &in.Login); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("login", "type", "type", "login", "string"),
+			}
+		}
+	}
+	if err := ValidateProfileParams(&in); err != nil {
+		return nil, err
+	}
+	return h.Service.ProfileV2(r.Context(), in)
+}
+
+func (h *MyApiHandler) rpcCreate(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if ok, _ := h.limiterCreate.allow(rateKeyIP(r)); !ok {
+		return nil, ApiError{HTTPStatus: http.StatusTooManyRequests, Err: fmt.Errorf("too many requests"), Code: "rate_limited"}
+	}
+	if r.Header.Get("X-Auth") != "100500" {
+		return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("unauthorized"), Code: "unauthorized"}
+	}
+	if len(params) > 1048576 {
+		return nil, ApiError{
+			HTTPStatus: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("request body must be at most %d bytes", 1048576),
+			Code:       "body_too_large",
+		}
+	}
+	raw := map[string]json.RawMessage{}
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("params must be an object"), Code: "bad_params"}
+		}
+	}
+	for k := range raw {
+		switch k {
+		case "login", "full_name", "status", "age":
+		default:
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError(k, "unknown", "unknown", k),
+			}
+		}
+	}
+	in := CreateParams{}
+	if v, ok := raw["login"]; ok {
+		if err := json.Unmarshal(v, &in.Login); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("login", "type", "type", "login", "string"),
+			}
+		}
+	}
+	if v, ok := raw["full_name"]; ok {
+		if err := json.Unmarshal(v, &in.Name); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("full_name", "type", "type", "full_name", "string"),
+			}
+		}
+	}
+	if v, ok := raw["status"]; ok {
+		if err := json.Unmarshal(v, &in.Status); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("status", "type", "type", "status", "string"),
+			}
+		}
+	}
+	if v, ok := raw["age"]; ok {
+		if err := json.Unmarshal(v, &in.Age); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("age", "type", "type", "age", "int"),
+			}
+		}
+	}
+	if err := ValidateCreateParams(&in); err != nil {
+		return nil, err
+	}
+	return h.Service.Create(r.Context(), in)
+}
+
+func (h *OtherApiHandler) rpcCreate(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if r.Header.Get("X-Auth") != "100500" {
+		return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("unauthorized"), Code: "unauthorized"}
+	}
+	// the token is checked, fake ones do not get buckets
+	if ok, _ := h.limiterCreate.allow(rateKeyAuth(r)); !ok {
+		return nil, ApiError{HTTPStatus: http.StatusTooManyRequests, Err: fmt.Errorf("too many requests"), Code: "rate_limited"}
+	}
+	raw := map[string]json.RawMessage{}
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("params must be an object"), Code: "bad_params"}
+		}
+	}
+	in := OtherCreateParams{}
+	if v, ok := raw["username"]; ok {
+		if err := json.Unmarshal(v, &in.Username); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("username", "type", "type", "username", "string"),
+			}
+		}
+	}
+	if v, ok := raw["account_name"]; ok {
+		if err := json.Unmarshal(v, &in.Name); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("account_name", "type", "type", "account_name", "string"),
+			}
+		}
+	}
+	if v, ok := raw["class"]; ok {
+		if err := json.Unmarshal(v, &in.Class); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("class", "type", "type", "class", "string"),
+			}
+		}
+	}
+	if v, ok := raw["level"]; ok {
+		if err := json.Unmarshal(v, &in.Level); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("level", "type", "type", "level", "int"),
+			}
+		}
+	}
+	if err := ValidateOtherCreateParams(&in); err != nil {
+		return nil, err
+	}
+	return h.Service.Create(r.Context(), in)
+}
+
+// NewRouter serves all receivers from one mux, each at the mount and prefix of
+// its apigen:service annotation. Routes are checked for conflicts when the code is generated,
+// handlers are checked for missing middlewares here.
+func NewRouter(myApi *MyApiHandler, otherApi *OtherApiHandler) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	if err := myApi.RegisterRoutes(mux, "/user"); err != nil {
+		return nil, err
+	}
+	if err := otherApi.RegisterRoutes(mux, "/other/user"); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+const routesMyApi = `{"batch":true,"prefix":"/user","receiver":"MyApi","routes":[{"url":"/user/profile","handler":"Profile","methods":["GET","POST"],"auth":false,"cache":"60s","cors":{"origins":["*"],"expose_headers":["ETag","Deprecation","Sunset","Link"],"max_age":"1h"},"deprecated":{"sunset":"2027-01-01","replacement":"/v2/user/profile"},"params":[{"name":"login","type":"string","required":true}]},{"url":"/v2/user/profile","handler":"ProfileV2","methods":["GET","POST"],"auth":false,"cache":"60s","cors":{"origins":["*"],"max_age":"1h"},"version":"v2","params":[{"name":"login","type":"string","required":true}]},{"url":"/user/create","handler":"Create","methods":["POST"],"auth":true,"middleware":["nostore"],"rate":"10/s","burst":20,"key":"ip","idempotent":true,"max_body":"1MB","strict":true,"params":[{"name":"login","type":"string","required":true,"min":10},{"name":"full_name","type":"string"},{"name":"status","type":"string","enum":["user","moderator","admin"],"default":"user"},{"name":"age","type":"int","min":0,"max":128}]},{"url":"/user/export","handler":"Export","methods":["GET","POST"],"auth":true,"stream":"ndjson","params":[{"name":"limit","type":"int","min":0,"max":1000}]},{"url":"/user/feed","handler":"Feed","methods":["GET","POST"],"auth":true,"stream":"sse","params":[{"name":"limit","type":"int","min":0,"max":1000}]},{"url":"/user/avatar","handler":"Avatar","methods":["POST"],"auth":true,"max_body":"6MB","params":[{"name":"login","type":"string","required":true},{"name":"avatar","type":"*multipart.FileHeader","required":true}]}]}`
+
+const openapiMyApi = `{
+  "components": {
+    "schemas": {
+      "AvatarInfo": {
+        "properties": {
+          "login": {
+            "type": "string"
+          },
+          "size": {
+            "type": "integer"
+          }
+        },
+        "type": "object"
+      },
+      "Error": {
+        "properties": {
+          "code": {
+            "description": "stable code of the error, validation.\u003crule\u003e for invalid params, unauthorized, method_not_allowed, rate_limited, not_acceptable, body_too_large, bad_body, not_found, internal or idempotency_* for rejected requests, codes of the service otherwise",
+            "type": "string"
+          },
+          "details": {
+            "type": "object"
+          },
+          "error": {
+            "type": "string"
+          }
+        },
+        "type": "object"
+      },
+      "NewUser": {
+        "properties": {
+          "id": {
+            "type": "integer"
+          }
+        },
+        "type": "object"
+      },
+      "User": {
+        "properties": {
+          "full_name": {
+            "type": "string"
+          },
+          "id": {
+            "type": "integer"
+          },
+          "login": {
+            "type": "string"
+          },
+          "status": {
+            "type": "integer"
+          }
+        },
+        "type": "object"
+      }
+    },
+    "securitySchemes": {
+      "auth": {
+        "in": "header",
+        "name": "X-Auth",
+        "type": "apiKey"
+      }
+    }
+  },
+  "info": {
+    "title": "MyApi",
+    "version": "1.0.0"
+  },
+  "openapi": "3.0.3",
+  "paths": {
+    "/user/avatar": {
+      "post": {
+        "operationId": "Avatar",
+        "requestBody": {
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "properties": {
+                  "avatar": {
+                    "description": "at most 5242880 bytes",
+                    "format": "binary",
+                    "type": "string",
+                    "x-mime-types": [
+                      "image/png",
+                      "image/jpeg"
+                    ]
+                  },
+                  "login": {
+                    "type": "string"
+                  }
+                },
+                "required": [
+                  "login",
+                  "avatar"
+                ],
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/AvatarInfo"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "413": {
+            "description": "request body is over 6MB"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      }
+    },
+    "/user/create": {
+      "post": {
+        "operationId": "Create",
+        "parameters": [
+          {
+            "description": "repeats with the same key get the first response",
+            "in": "header",
+            "name": "Idempotency-Key",
+            "schema": {
+              "maxLength": 255,
+              "type": "string"
+            }
+          }
+        ],
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "age": {
+                    "maximum": 128,
+                    "minimum": 0,
+                    "type": "integer"
+                  },
+                  "full_name": {
+                    "type": "string"
+                  },
+                  "login": {
+                    "minLength": 10,
+                    "type": "string"
+                  },
+                  "status": {
+                    "default": "user",
+                    "enum": [
+                      "user",
+                      "moderator",
+                      "admin"
+                    ],
+                    "type": "string"
+                  }
+                },
+                "required": [
+                  "login"
+                ],
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/NewUser"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "413": {
+            "description": "request body is over 1MB"
+          },
+          "422": {
+            "description": "idempotency key is reused with different params"
+          },
+          "429": {
+            "description": "rate limit of 10/s exceeded",
+            "headers": {
+              "Retry-After": {
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            }
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      }
+    },
+    "/user/export": {
+      "get": {
+        "operationId": "Export",
+        "parameters": [
+          {
+            "in": "query",
+            "name": "limit",
+            "required": false,
+            "schema": {
+              "maximum": 1000,
+              "minimum": 0,
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "content": {
+              "application/x-ndjson": {
+                "schema": {
+                  "$ref": "#/components/schemas/User"
+                }
+              }
+            },
+            "description": "stream of items"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      },
+      "post": {
+        "operationId": "Export",
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "limit": {
+                    "maximum": 1000,
+                    "minimum": 0,
+                    "type": "integer"
+                  }
+                },
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/x-ndjson": {
+                "schema": {
+                  "$ref": "#/components/schemas/User"
+                }
+              }
+            },
+            "description": "stream of items"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      }
+    },
+    "/user/feed": {
+      "get": {
+        "operationId": "Feed",
+        "parameters": [
+          {
+            "in": "query",
+            "name": "limit",
+            "required": false,
+            "schema": {
+              "maximum": 1000,
+              "minimum": 0,
+              "type": "integer"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "content": {
+              "text/event-stream": {
+                "schema": {
+                  "$ref": "#/components/schemas/User"
+                }
+              }
+            },
+            "description": "stream of items"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      },
+      "post": {
+        "operationId": "Feed",
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "limit": {
+                    "maximum": 1000,
+                    "minimum": 0,
+                    "type": "integer"
+                  }
+                },
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "text/event-stream": {
+                "schema": {
+                  "$ref": "#/components/schemas/User"
+                }
+              }
+            },
+            "description": "stream of items"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      }
+    },
+    "/user/profile": {
+      "get": {
+        "deprecated": true,
+        "description": "deprecated, goes away on 2027-01-01, use /v2/user/profile instead",
+        "operationId": "Profile",
+        "parameters": [
+          {
+            "in": "query",
+            "name": "login",
+            "required": true,
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/User"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "304": {
+            "description": "not modified since the ETag of If-None-Match"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        }
+      },
+      "post": {
+        "deprecated": true,
+        "description": "deprecated, goes away on 2027-01-01, use /v2/user/profile instead",
+        "operationId": "Profile",
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "login": {
+                    "type": "string"
+                  }
+                },
+                "required": [
+                  "login"
+                ],
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/User"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        }
+      }
+    },
+    "/v2/user/profile": {
+      "get": {
+        "operationId": "ProfileV2",
+        "parameters": [
+          {
+            "in": "query",
+            "name": "login",
+            "required": true,
+            "schema": {
+              "type": "string"
+            }
+          }
+        ],
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/User"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "304": {
+            "description": "not modified since the ETag of If-None-Match"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        }
+      },
+      "post": {
+        "operationId": "ProfileV2",
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "login": {
+                    "type": "string"
+                  }
+                },
+                "required": [
+                  "login"
+                ],
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/User"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        }
+      }
+    }
+  }
+}`
+
+const routesOtherApi = `{"batch":false,"prefix":"/user","receiver":"OtherApi","routes":[{"url":"/user/create","handler":"Create","methods":["POST"],"auth":true,"rate":"1/m","burst":5,"key":"auth","params":[{"name":"username","type":"string","required":true,"min":3},{"name":"account_name","type":"string"},{"name":"class","type":"string","enum":["warrior","sorcerer","rouge"],"default":"warrior"},{"name":"level","type":"int","min":1,"max":50}]}]}`
+
+const openapiOtherApi = `{
+  "components": {
+    "schemas": {
+      "Error": {
+        "properties": {
+          "code": {
+            "description": "stable code of the error, validation.\u003crule\u003e for invalid params, unauthorized, method_not_allowed, rate_limited, not_acceptable, body_too_large, bad_body, not_found, internal or idempotency_* for rejected requests, codes of the service otherwise",
+            "type": "string"
+          },
+          "details": {
+            "type": "object"
+          },
+          "error": {
+            "type": "string"
+          }
+        },
+        "type": "object"
+      },
+      "OtherUser": {
+        "properties": {
+          "full_name": {
+            "type": "string"
+          },
+          "id": {
+            "type": "integer"
+          },
+          "level": {
+            "type": "integer"
+          },
+          "login": {
+            "type": "string"
+          }
+        },
+        "type": "object"
+      }
+    },
+    "securitySchemes": {
+      "auth": {
+        "in": "header",
+        "name": "X-Auth",
+        "type": "apiKey"
+      }
+    }
+  },
+  "info": {
+    "title": "OtherApi",
+    "version": "1.0.0"
+  },
+  "openapi": "3.0.3",
+  "paths": {
+    "/user/create": {
+      "post": {
+        "operationId": "Create",
+        "requestBody": {
+          "content": {
+            "application/x-www-form-urlencoded": {
+              "schema": {
+                "properties": {
+                  "account_name": {
+                    "type": "string"
+                  },
+                  "class": {
+                    "default": "warrior",
+                    "enum": [
+                      "warrior",
+                      "sorcerer",
+                      "rouge"
+                    ],
+                    "type": "string"
+                  },
+                  "level": {
+                    "maximum": 50,
+                    "minimum": 1,
+                    "type": "integer"
+                  },
+                  "username": {
+                    "minLength": 3,
+                    "type": "string"
+                  }
+                },
+                "required": [
+                  "username"
+                ],
+                "type": "object"
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "properties": {
+                    "error": {
+                      "type": "string"
+                    },
+                    "response": {
+                      "$ref": "#/components/schemas/OtherUser"
+                    }
+                  },
+                  "type": "object"
+                }
+              }
+            },
+            "description": "success"
+          },
+          "429": {
+            "description": "rate limit of 1/m exceeded",
+            "headers": {
+              "Retry-After": {
+                "schema": {
+                  "type": "integer"
+                }
+              }
+            }
+          },
+          "default": {
+            "content": {
+              "application/json": {
+                "schema": {
+                  "$ref": "#/components/schemas/Error"
+                }
+              }
+            },
+            "description": "error"
+          }
+        },
+        "security": [
+          {
+            "auth": []
+          }
+        ]
+      }
+    }
+  }
+}`
@@ -0,0 +1,747 @@
+package week1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type apigenCase struct {
+	Name   string
+	Method string
+	Query  string
+	Auth   string
+	Status int
+	Error  string
+	// Field of params must get Value when they reach the service
+	Field string
+	Value string
+	// Files go along with Query in a multipart/form-data body
+	Files map[string]string
+}
+
+// runApigenCases sends every case to a new handler, so that state like rate limits
+// of one case does not affect others
+func runApigenCases(t *testing.T, newHandler func() http.Handler, path string, cases []apigenCase, lastCall func() interface{}) {
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var req *http.Request
+			if c.Method == http.MethodGet {
+				req = httptest.NewRequest(c.Method, path+"?"+c.Query, nil)
+			} else if len(c.Files) > 0 {
+				body := &bytes.Buffer{}
+				mw := multipart.NewWriter(body)
+				values, _ := url.ParseQuery(c.Query)
+				for k, vv := range values {
+					for _, v := range vv {
+						mw.WriteField(k, v)
+					}
+				}
+				for name, content := range c.Files {
+					part, _ := mw.CreateFormFile(name, name)
+					part.Write([]byte(content))
+				}
+				mw.Close()
+				req = httptest.NewRequest(c.Method, path, body)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+			} else {
+				req = httptest.NewRequest(c.Method, path, strings.NewReader(c.Query))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if c.Auth != "" {
+				req.Header.Set("X-Auth", c.Auth)
+			}
+			w := httptest.NewRecorder()
+			newHandler().ServeHTTP(w, req)
+			if w.Code != c.Status {
+				t.Fatalf("expected http status %v, got %v: %s", c.Status, w.Code, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") == "text/event-stream" {
+				// the mock sends a single event
+				if !strings.HasPrefix(w.Body.String(), "data: ") {
+					t.Fatalf("expected an event, got %s", w.Body.String())
+				}
+				return
+			}
+			res := struct {
+				Error *string `json:"error"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("cant unpack json: %v", err)
+			}
+			if res.Error == nil || *res.Error != c.Error {
+				t.Fatalf("expected error %q, got %s", c.Error, w.Body.String())
+			}
+			if c.Field != "" {
+				got := fmt.Sprint(reflect.ValueOf(lastCall()).FieldByName(c.Field).Interface())
+				if got != c.Value {
+					t.Fatalf("expected %s to be %q, got %q", c.Field, c.Value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestApigenMyApiProfile(t *testing.T) {
+	mock := &MyApiMock{
+		ProfileFunc: func(ctx context.Context, in ProfileParams) (*User, error) {
+			return &User{}, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "GET",
+			Query:  "login=a",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "login missing",
+			Method: "GET",
+			Query:  "",
+			Status: 400,
+			Error:  "login must me not empty",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/profile", cases, func() interface{} {
+		calls := mock.ProfileCalls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenMyApiProfileV2(t *testing.T) {
+	mock := &MyApiMock{
+		ProfileV2Func: func(ctx context.Context, in ProfileParams) (*User, error) {
+			return &User{}, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "GET",
+			Query:  "login=a",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "login missing",
+			Method: "GET",
+			Query:  "",
+			Status: 400,
+			Error:  "login must me not empty",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/v2/user/profile", cases, func() interface{} {
+		calls := mock.ProfileV2Calls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenMyApiCreate(t *testing.T) {
+	mock := &MyApiMock{
+		CreateFunc: func(ctx context.Context, in CreateParams) (*NewUser, error) {
+			return &NewUser{}, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "wrong method",
+			Method: "GET",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 406,
+			Error:  "bad method",
+		},
+		{
+			Name:   "missing auth",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "wrong auth",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "wrong",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "login missing",
+			Method: "POST",
+			Query:  "age=0&full_name=a&status=user",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "login must me not empty",
+		},
+		{
+			Name:   "login min len",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Login",
+			Value:  "aaaaaaaaaa",
+		},
+		{
+			Name:   "login min len-1",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "login len must be >= 10",
+		},
+		{
+			Name:   "status user",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Status",
+			Value:  "user",
+		},
+		{
+			Name:   "status moderator",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=moderator",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Status",
+			Value:  "moderator",
+		},
+		{
+			Name:   "status admin",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=admin",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Status",
+			Value:  "admin",
+		},
+		{
+			Name:   "status not in enum",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=apigen_invalid",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "status must be one of [user, moderator, admin]",
+		},
+		{
+			Name:   "status default",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Status",
+			Value:  "user",
+		},
+		{
+			Name:   "age not int",
+			Method: "POST",
+			Query:  "age=x&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "age must be int",
+		},
+		{
+			Name:   "age min",
+			Method: "POST",
+			Query:  "age=0&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Age",
+			Value:  "0",
+		},
+		{
+			Name:   "age min-1",
+			Method: "POST",
+			Query:  "age=-1&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "age must be >= 0",
+		},
+		{
+			Name:   "age max",
+			Method: "POST",
+			Query:  "age=128&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Age",
+			Value:  "128",
+		},
+		{
+			Name:   "age max+1",
+			Method: "POST",
+			Query:  "age=129&full_name=a&login=aaaaaaaaaa&status=user",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "age must be <= 128",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		h.RegisterMiddleware("nostore", func(next http.Handler) http.Handler { return next })
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/create", cases, func() interface{} {
+		calls := mock.CreateCalls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenMyApiExport(t *testing.T) {
+	mock := &MyApiMock{
+		ExportFunc: func(ctx context.Context, in ExportParams) (<-chan *User, error) {
+			var item *User
+			items := make(chan *User, 1)
+			items <- item
+			close(items)
+			return items, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "missing auth",
+			Method: "GET",
+			Query:  "limit=0",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "wrong auth",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "wrong",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "limit not int",
+			Method: "GET",
+			Query:  "limit=x",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be int",
+		},
+		{
+			Name:   "limit min",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Limit",
+			Value:  "0",
+		},
+		{
+			Name:   "limit min-1",
+			Method: "GET",
+			Query:  "limit=-1",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be >= 0",
+		},
+		{
+			Name:   "limit max",
+			Method: "GET",
+			Query:  "limit=1000",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Limit",
+			Value:  "1000",
+		},
+		{
+			Name:   "limit max+1",
+			Method: "GET",
+			Query:  "limit=1001",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be <= 1000",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/export", cases, func() interface{} {
+		calls := mock.ExportCalls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenMyApiFeed(t *testing.T) {
+	mock := &MyApiMock{
+		FeedFunc: func(ctx context.Context, in ExportParams, send func(*User) error) error {
+			var item *User
+			return send(item)
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "missing auth",
+			Method: "GET",
+			Query:  "limit=0",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "wrong auth",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "wrong",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "limit not int",
+			Method: "GET",
+			Query:  "limit=x",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be int",
+		},
+		{
+			Name:   "limit min",
+			Method: "GET",
+			Query:  "limit=0",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Limit",
+			Value:  "0",
+		},
+		{
+			Name:   "limit min-1",
+			Method: "GET",
+			Query:  "limit=-1",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be >= 0",
+		},
+		{
+			Name:   "limit max",
+			Method: "GET",
+			Query:  "limit=1000",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Limit",
+			Value:  "1000",
+		},
+		{
+			Name:   "limit max+1",
+			Method: "GET",
+			Query:  "limit=1001",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "limit must be <= 1000",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/feed", cases, func() interface{} {
+		calls := mock.FeedCalls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenMyApiAvatar(t *testing.T) {
+	mock := &MyApiMock{
+		AvatarFunc: func(ctx context.Context, in AvatarParams) (*AvatarInfo, error) {
+			return &AvatarInfo{}, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "POST",
+			Query:  "login=a",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Files: map[string]string{
+				"avatar": "\x89PNG\r\n\x1a\n",
+			},
+		},
+		{
+			Name:   "wrong method",
+			Method: "GET",
+			Query:  "login=a",
+			Auth:   "100500",
+			Status: 406,
+			Error:  "bad method",
+		},
+		{
+			Name:   "missing auth",
+			Method: "POST",
+			Query:  "login=a",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "wrong auth",
+			Method: "POST",
+			Query:  "login=a",
+			Auth:   "wrong",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "login missing",
+			Method: "POST",
+			Query:  "",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "login must me not empty",
+			Files: map[string]string{
+				"avatar": "\x89PNG\r\n\x1a\n",
+			},
+		},
+		{
+			Name:   "avatar missing",
+			Method: "POST",
+			Query:  "login=a",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "avatar must me not empty",
+		},
+		{
+			Name:   "avatar bad type",
+			Method: "POST",
+			Query:  "login=a",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "avatar must be one of [image/png, image/jpeg]",
+			Files: map[string]string{
+				"avatar": "apigen invalid",
+			},
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewMyApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/avatar", cases, func() interface{} {
+		calls := mock.AvatarCalls()
+		return calls[len(calls)-1]
+	})
+}
+
+func TestApigenOtherApiCreate(t *testing.T) {
+	mock := &OtherApiMock{
+		CreateFunc: func(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+			return &OtherUser{}, nil
+		},
+	}
+	cases := []apigenCase{
+		{
+			Name:   "valid",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+		},
+		{
+			Name:   "wrong method",
+			Method: "GET",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 406,
+			Error:  "bad method",
+		},
+		{
+			Name:   "missing auth",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "wrong auth",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "wrong",
+			Status: 403,
+			Error:  "unauthorized",
+		},
+		{
+			Name:   "username missing",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "username must me not empty",
+		},
+		{
+			Name:   "username min len",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Username",
+			Value:  "aaa",
+		},
+		{
+			Name:   "username min len-1",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aa",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "username len must be >= 3",
+		},
+		{
+			Name:   "class warrior",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Class",
+			Value:  "warrior",
+		},
+		{
+			Name:   "class sorcerer",
+			Method: "POST",
+			Query:  "account_name=a&class=sorcerer&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Class",
+			Value:  "sorcerer",
+		},
+		{
+			Name:   "class rouge",
+			Method: "POST",
+			Query:  "account_name=a&class=rouge&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Class",
+			Value:  "rouge",
+		},
+		{
+			Name:   "class not in enum",
+			Method: "POST",
+			Query:  "account_name=a&class=apigen_invalid&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "class must be one of [warrior, sorcerer, rouge]",
+		},
+		{
+			Name:   "class default",
+			Method: "POST",
+			Query:  "account_name=a&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Class",
+			Value:  "warrior",
+		},
+		{
+			Name:   "level not int",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=x&username=aaa",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "level must be int",
+		},
+		{
+			Name:   "level min",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=1&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Level",
+			Value:  "1",
+		},
+		{
+			Name:   "level min-1",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=0&username=aaa",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "level must be >= 1",
+		},
+		{
+			Name:   "level max",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=50&username=aaa",
+			Auth:   "100500",
+			Status: 200,
+			Error:  "",
+			Field:  "Level",
+			Value:  "50",
+		},
+		{
+			Name:   "level max+1",
+			Method: "POST",
+			Query:  "account_name=a&class=warrior&level=51&username=aaa",
+			Auth:   "100500",
+			Status: 400,
+			Error:  "level must be <= 50",
+		},
+	}
+	newHandler := func() http.Handler {
+		h := NewOtherApiHandler(mock)
+		return h
+	}
+	runApigenCases(t, newHandler, "/user/create", cases, func() interface{} {
+		calls := mock.CreateCalls()
+		return calls[len(calls)-1]
+	})
+}
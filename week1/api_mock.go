@@ -0,0 +1,174 @@
+package week1
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MyApiMock is a MyApiService with stubbed methods which records its calls
+type MyApiMock struct {
+	mu             sync.Mutex
+	ProfileFunc    func(ctx context.Context, in ProfileParams) (*User, error)
+	ProfileV2Func  func(ctx context.Context, in ProfileParams) (*User, error)
+	CreateFunc     func(ctx context.Context, in CreateParams) (*NewUser, error)
+	ExportFunc     func(ctx context.Context, in ExportParams) (<-chan *User, error)
+	FeedFunc       func(ctx context.Context, in ExportParams, send func(*User) error) error
+	AvatarFunc     func(ctx context.Context, in AvatarParams) (*AvatarInfo, error)
+	callsProfile   []ProfileParams
+	callsProfileV2 []ProfileParams
+	callsCreate    []CreateParams
+	callsExport    []ExportParams
+	callsFeed      []ExportParams
+	callsAvatar    []AvatarParams
+}
+
+var _ MyApiService = &MyApiMock{}
+
+func (m *MyApiMock) Profile(ctx context.Context, in ProfileParams) (*User, error) {
+	m.mu.Lock()
+	m.callsProfile = append(m.callsProfile, in)
+	m.mu.Unlock()
+	if m.ProfileFunc == nil {
+		var res *User
+		return res, fmt.Errorf("MyApiMock.Profile is not stubbed")
+	}
+	return m.ProfileFunc(ctx, in)
+}
+
+// ProfileCalls returns params of all Profile calls
+func (m *MyApiMock) ProfileCalls() []ProfileParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]ProfileParams, len(m.callsProfile))
+	copy(res, m.callsProfile)
+	return res
+}
+
+func (m *MyApiMock) ProfileV2(ctx context.Context, in ProfileParams) (*User, error) {
+	m.mu.Lock()
+	m.callsProfileV2 = append(m.callsProfileV2, in)
+	m.mu.Unlock()
+	if m.ProfileV2Func == nil {
+		var res *User
+		return res, fmt.Errorf("MyApiMock.ProfileV2 is not stubbed")
+	}
+	return m.ProfileV2Func(ctx, in)
+}
+
+// ProfileV2Calls returns params of all ProfileV2 calls
+func (m *MyApiMock) ProfileV2Calls() []ProfileParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]ProfileParams, len(m.callsProfileV2))
+	copy(res, m.callsProfileV2)
+	return res
+}
+
+func (m *MyApiMock) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
+	m.mu.Lock()
+	m.callsCreate = append(m.callsCreate, in)
+	m.mu.Unlock()
+	if m.CreateFunc == nil {
+		var res *NewUser
+		return res, fmt.Errorf("MyApiMock.Create is not stubbed")
+	}
+	return m.CreateFunc(ctx, in)
+}
+
+// CreateCalls returns params of all Create calls
+func (m *MyApiMock) CreateCalls() []CreateParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]CreateParams, len(m.callsCreate))
+	copy(res, m.callsCreate)
+	return res
+}
+
+func (m *MyApiMock) Export(ctx context.Context, in ExportParams) (<-chan *User, error) {
+	m.mu.Lock()
+	m.callsExport = append(m.callsExport, in)
+	m.mu.Unlock()
+	if m.ExportFunc == nil {
+		var res <-chan *User
+		return res, fmt.Errorf("MyApiMock.Export is not stubbed")
+	}
+	return m.ExportFunc(ctx, in)
+}
+
+// ExportCalls returns params of all Export calls
+func (m *MyApiMock) ExportCalls() []ExportParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]ExportParams, len(m.callsExport))
+	copy(res, m.callsExport)
+	return res
+}
+
+func (m *MyApiMock) Feed(ctx context.Context, in ExportParams, send func(*User) error) error {
+	m.mu.Lock()
+	m.callsFeed = append(m.callsFeed, in)
+	m.mu.Unlock()
+	if m.FeedFunc == nil {
+		return fmt.Errorf("MyApiMock.Feed is not stubbed")
+	}
+	return m.FeedFunc(ctx, in, send)
+}
+
+// FeedCalls returns params of all Feed calls
+func (m *MyApiMock) FeedCalls() []ExportParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]ExportParams, len(m.callsFeed))
+	copy(res, m.callsFeed)
+	return res
+}
+
+func (m *MyApiMock) Avatar(ctx context.Context, in AvatarParams) (*AvatarInfo, error) {
+	m.mu.Lock()
+	m.callsAvatar = append(m.callsAvatar, in)
+	m.mu.Unlock()
+	if m.AvatarFunc == nil {
+		var res *AvatarInfo
+		return res, fmt.Errorf("MyApiMock.Avatar is not stubbed")
+	}
+	return m.AvatarFunc(ctx, in)
+}
+
+// AvatarCalls returns params of all Avatar calls
+func (m *MyApiMock) AvatarCalls() []AvatarParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]AvatarParams, len(m.callsAvatar))
+	copy(res, m.callsAvatar)
+	return res
+}
+
+// OtherApiMock is a OtherApiService with stubbed methods which records its calls
+type OtherApiMock struct {
+	mu          sync.Mutex
+	CreateFunc  func(ctx context.Context, in OtherCreateParams) (*OtherUser, error)
+	callsCreate []OtherCreateParams
+}
+
+var _ OtherApiService = &OtherApiMock{}
+
+func (m *OtherApiMock) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+	m.mu.Lock()
+	m.callsCreate = append(m.callsCreate, in)
+	m.mu.Unlock()
+	if m.CreateFunc == nil {
+		var res *OtherUser
+		return res, fmt.Errorf("OtherApiMock.Create is not stubbed")
+	}
+	return m.CreateFunc(ctx, in)
+}
+
+// CreateCalls returns params of all Create calls
+func (m *OtherApiMock) CreateCalls() []OtherCreateParams {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]OtherCreateParams, len(m.callsCreate))
+	copy(res, m.callsCreate)
+	return res
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ApiError is returned when the server answers with an error
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	// Code is the stable code of the error, validation errors have validation.<rule> ones
+	Code    string
+	Details map[string]interface{}
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+type ProfileParams struct {
+	Login string `apivalidator:"required"`
+}
+
+type CreateParams struct {
+	Login  string `apivalidator:"required,min=10"`
+	Name   string `apivalidator:"paramname=full_name"`
+	Status string `apivalidator:"enum=user|moderator|admin,default=user"`
+	Age    int    `apivalidator:"min=0,max=128"`
+}
+
+type User struct {
+	ID       uint64 `json:"id" xml:"id"`
+	Login    string `json:"login" xml:"login"`
+	FullName string `json:"full_name" xml:"full_name"`
+	Status   int    `json:"status" xml:"status"`
+}
+
+type NewUser struct {
+	ID uint64 `json:"id" xml:"id"`
+}
+
+type OtherCreateParams struct {
+	Username string `apivalidator:"required,min=3"`
+	Name     string `apivalidator:"paramname=account_name"`
+	Class    string `apivalidator:"enum=warrior|sorcerer|rouge,default=warrior"`
+	Level    int    `apivalidator:"min=1,max=50"`
+}
+
+type OtherUser struct {
+	ID       uint64 `json:"id"`
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+	Level    int    `json:"level"`
+}
+
+type envelope struct {
+	Error    string                 `json:"error"`
+	Code     string                 `json:"code"`
+	Details  map[string]interface{} `json:"details"`
+	Response json.RawMessage        `json:"response"`
+}
+
+func call(ctx context.Context, hc *http.Client, method, u string, v url.Values, auth string, out interface{}) error {
+	var (
+		req *http.Request
+		err error
+	)
+	if method == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, method, u+"?"+v.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, u, strings.NewReader(v.Encode()))
+	}
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if auth != "" {
+		req.Header.Set("X-Auth", auth)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	env := envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return ApiError{
+			HTTPStatus: resp.StatusCode,
+			Err:        fmt.Errorf("bad response: %v", err),
+		}
+	}
+	if resp.StatusCode != http.StatusOK || env.Error != "" {
+		return ApiError{
+			HTTPStatus: resp.StatusCode,
+			Err:        errors.New(env.Error),
+			Code:       env.Code,
+			Details:    env.Details,
+		}
+	}
+	return json.Unmarshal(env.Response, out)
+}
+
+// MyApiClient calls MyApi over http
+type MyApiClient struct {
+	BaseURL    string
+	Auth       string
+	HTTPClient *http.Client
+}
+
+func NewMyApiClient(baseURL, auth string) *MyApiClient {
+	return &MyApiClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Auth:       auth,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Deprecated: /user/profile goes away on 2027-01-01, use /v2/user/profile instead.
+func (c *MyApiClient) Profile(ctx context.Context, in ProfileParams) (*User, error) {
+	v := url.Values{}
+	v.Set("login", in.Login)
+	out := &User{}
+	err := call(ctx, c.HTTPClient, "GET", c.BaseURL+"/user/profile", v, "", out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *MyApiClient) ProfileV2(ctx context.Context, in ProfileParams) (*User, error) {
+	v := url.Values{}
+	v.Set("login", in.Login)
+	out := &User{}
+	err := call(ctx, c.HTTPClient, "GET", c.BaseURL+"/v2/user/profile", v, "", out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *MyApiClient) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
+	v := url.Values{}
+	v.Set("login", in.Login)
+	v.Set("full_name", in.Name)
+	v.Set("status", in.Status)
+	v.Set("age", fmt.Sprint(in.Age))
+	out := &NewUser{}
+	err := call(ctx, c.HTTPClient, "POST", c.BaseURL+"/user/create", v, c.Auth, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OtherApiClient calls OtherApi over http
+type OtherApiClient struct {
+	BaseURL    string
+	Auth       string
+	HTTPClient *http.Client
+}
+
+func NewOtherApiClient(baseURL, auth string) *OtherApiClient {
+	return &OtherApiClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Auth:       auth,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *OtherApiClient) Create(ctx context.Context, in OtherCreateParams) (*OtherUser, error) {
+	v := url.Values{}
+	v.Set("username", in.Username)
+	v.Set("account_name", in.Name)
+	v.Set("class", in.Class)
+	v.Set("level", fmt.Sprint(in.Level))
+	out := &OtherUser{}
+	err := call(ctx, c.HTTPClient, "POST", c.BaseURL+"/user/create", v, c.Auth, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
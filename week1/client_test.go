@@ -0,0 +1,36 @@
+package week1
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	apiclient "./client"
+)
+
+func TestClient(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	c := apiclient.NewMyApiClient(ts.URL, "100500")
+	in := apiclient.CreateParams{Login: "mr.moderator", Name: "Ivan", Status: "moderator", Age: 32}
+	user, err := c.Create(context.Background(), in)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(user, &apiclient.NewUser{ID: 43}) {
+		t.Errorf("unexpected user: %+v", user)
+	}
+
+	_, err = c.Create(context.Background(), in)
+	apiErr := apiclient.ApiError{}
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected ApiError, got %v", err)
+	}
+	if apiErr.HTTPStatus != http.StatusConflict || apiErr.Code != "user_exists" || apiErr.Error() != "user mr.moderator exist" {
+		t.Errorf("unexpected error: %+v", apiErr)
+	}
+}
@@ -0,0 +1,3 @@
+package week1
+
+//go:generate go run ./handlers_gen -openapi openapi -client client -ts api.ts -mock api_mock.go -tests api_handlers_test.go -fuzz api_fuzz_test.go api.go api_handlers.go
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"text/template"
+)
+
+var (
+	accessLogTmpl = template.Must(template.New("accessLogTmpl").Parse(`
+// ValidationError is the reason params of a request are rejected
+type ValidationError struct {
+	Field   string
+	Rule    string
+	Message string
+	// Key and Args make the message in other languages, see ValidationMessages
+	Key  string
+	Args []interface{}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the X-Request-Id of the request served with ctx
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID generates an id for requests which come without X-Request-Id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids of clients which are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// beginCall starts tracking of a call of endpoint, the returned request
+// carries the call and the request id in its context
+func beginCall(w http.ResponseWriter, r *http.Request, endpoint string, m *apigenMetrics, logger *log.Logger) (*apigenCall, *http.Request) {
+	m.begin(endpoint)
+	id := r.Header.Get("X-Request-Id")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-Id", id)
+	c := &apigenCall{
+		ResponseWriter: w,
+		metrics:        m,
+		logger:         logger,
+		endpoint:       endpoint,
+		method:         r.Method,
+		requestID:      id,
+		start:          time.Now(),
+	}
+	if token := r.Header.Get("X-Auth"); token != "" {
+		// the token itself must not get into logs
+		sum := sha256.Sum256([]byte(token))
+		c.principal = "token:" + hex.EncodeToString(sum[:4])
+	}
+	ctx := context.WithValue(r.Context(), apigenCallKey{}, c)
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return c, r.WithContext(ctx)
+}
+
+// setInvalid marks the call as rejected because of its params
+func setInvalid(r *http.Request, err *ApiError) {
+	c, ok := r.Context().Value(apigenCallKey{}).(*apigenCall)
+	if !ok {
+		return
+	}
+	c.result = "invalid"
+	if ve, ok := err.Err.(*ValidationError); ok {
+		c.field = ve.Field
+		c.rule = ve.Rule
+	}
+}
+
+type apigenLogLine struct {
+	Time       string  ` + "`json:\"time\"`" + `
+	RequestID  string  ` + "`json:\"request_id\"`" + `
+	Receiver   string  ` + "`json:\"receiver\"`" + `
+	Endpoint   string  ` + "`json:\"endpoint\"`" + `
+	Method     string  ` + "`json:\"method\"`" + `
+	Status     int     ` + "`json:\"status\"`" + `
+	Result     string  ` + "`json:\"result\"`" + `
+	DurationMs float64 ` + "`json:\"duration_ms\"`" + `
+	Principal  string  ` + "`json:\"principal,omitempty\"`" + `
+	Field      string  ` + "`json:\"field,omitempty\"`" + `
+	Rule       string  ` + "`json:\"rule,omitempty\"`" + `
+}
+
+func (c *apigenCall) writeLog() {
+	line, _ := json.Marshal(apigenLogLine{
+		Time:       c.start.UTC().Format(time.RFC3339Nano),
+		RequestID:  c.requestID,
+		Receiver:   c.metrics.receiver,
+		Endpoint:   c.endpoint,
+		Method:     c.method,
+		Status:     c.status,
+		Result:     c.result,
+		DurationMs: float64(time.Since(c.start).Microseconds()) / 1000,
+		Principal:  c.principal,
+		Field:      c.field,
+		Rule:       c.rule,
+	})
+	c.logger.Println(string(line))
+}
+`))
+)
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"text/template"
+)
+
+var (
+	batchTmpl = template.Must(template.New("batchTmpl").Parse(`
+type batchRequest struct {
+	Method string                 ` + "`json:\"method\"`" + `
+	Url    string                 ` + "`json:\"url\"`" + `
+	Params map[string]interface{} ` + "`json:\"params\"`" + `
+}
+
+type batchResponse struct {
+	Status int         ` + "`json:\"status\"`" + `
+	Body   interface{} ` + "`json:\"body\"`" + `
+}
+
+// batchRecorder keeps the response to a request of a batch
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *batchRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// batchValues converts params of a request of a batch to form values
+func batchValues(params map[string]interface{}) (url.Values, error) {
+	v := url.Values{}
+	for k, el := range params {
+		switch val := el.(type) {
+		case nil:
+		case string:
+			v.Set(k, val)
+		case json.Number:
+			v.Set(k, val.String())
+		case bool:
+			v.Set(k, strconv.FormatBool(val))
+		default:
+			return nil, fmt.Errorf("param %s must be a string, number or bool", k)
+		}
+	}
+	return v, nil
+}
+
+// serveBatch runs requests of a batch with dispatch, at most concurrency of them at once.
+// The requests get headers of the batch request. A body over maxBody bytes is
+// answered with 413, 0 is no limit.
+func serveBatch(w http.ResponseWriter, r *http.Request, maxBatch, concurrency int, maxBody int64, dispatch func(http.ResponseWriter, *http.Request)) {
+	fail := func(status int, code, msg string) {
+		res := map[string]string{"error": msg, "code": code}
+		body, _ := json.Marshal(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+	if r.Method != http.MethodPost {
+		fail(http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	reqs := []batchRequest{}
+	if err := dec.Decode(&reqs); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+			return
+		}
+		fail(http.StatusBadRequest, "bad_batch", "batch must be an array of {method, url, params}")
+		return
+	}
+	if maxBatch > 0 && len(reqs) > maxBatch {
+		fail(http.StatusBadRequest, "batch_too_large", fmt.Sprintf("batch must have at most %d requests", maxBatch))
+		return
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]batchResponse, len(reqs))
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for ix, el := range reqs {
+		// requests start in order, one by one if concurrency is 1
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(ix int, el batchRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			values, err := batchValues(el.Params)
+			if err != nil {
+				results[ix] = batchResponse{Status: http.StatusBadRequest, Body: map[string]string{"error": err.Error(), "code": "bad_params"}}
+				return
+			}
+			method := el.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+			var sub *http.Request
+			if method == http.MethodGet {
+				sub, err = http.NewRequestWithContext(r.Context(), method, el.Url, nil)
+				if err == nil && len(values) > 0 {
+					sub.URL.RawQuery = values.Encode()
+				}
+			} else {
+				sub, err = http.NewRequestWithContext(r.Context(), method, el.Url, strings.NewReader(values.Encode()))
+			}
+			if err != nil {
+				results[ix] = batchResponse{Status: http.StatusBadRequest, Body: map[string]string{"error": "bad url", "code": "bad_url"}}
+				return
+			}
+			for k, vv := range r.Header {
+				switch k {
+				case "Content-Type", "Content-Length", "Idempotency-Key", "If-None-Match", "Accept":
+					// they belong to the batch request itself
+				default:
+					sub.Header[k] = vv
+				}
+			}
+			if method != http.MethodGet {
+				sub.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			sub.RemoteAddr = r.RemoteAddr
+
+			rec := &batchRecorder{header: make(http.Header)}
+			dispatch(rec, sub)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			res := batchResponse{Status: rec.status}
+			if body := rec.body.Bytes(); json.Valid(body) {
+				res.Body = json.RawMessage(body)
+			} else if len(body) > 0 {
+				res.Body = string(body)
+			}
+			results[ix] = res
+		}(ix, el)
+	}
+	wg.Wait()
+	body, _ := json.Marshal(results)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+`))
+)
+
+// batchMaxBody is the largest body limit of the endpoints a batch may call,
+// files are not sent in batches
+func batchMaxBody(points []ApiPoint) int64 {
+	res := int64(0)
+	for _, p := range points {
+		if !p.HasFiles() && p.Json.MaxBodyBytes > res {
+			res = p.Json.MaxBodyBytes
+		}
+	}
+	return res
+}
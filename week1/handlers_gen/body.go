@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+)
+
+var (
+	bodyTmpl = template.Must(template.New("bodyTmpl").Parse(`
+// readForm parses the query and the body of a request, a body over
+// http.MaxBytesReader limit is answered with 413
+func readForm(r *http.Request) *ApiError {
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(32 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+	if err == nil {
+		return nil
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &ApiError{
+			HTTPStatus: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("request body must be at most %d bytes", tooLarge.Limit),
+			Code:       "body_too_large",
+		}
+	}
+	return &ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("bad request body"), Code: "bad_body"}
+}
+
+// checkParams rejects params of a request other than known ones
+func checkParams(r *http.Request, known ...string) *ApiError {
+	names := make([]string, 0, len(r.Form))
+	for k := range r.Form {
+		names = append(names, k)
+	}
+	if r.MultipartForm != nil {
+		for k := range r.MultipartForm.File {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		found := false
+		for _, k := range known {
+			if k == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError(name, "unknown", "unknown", name),
+			}
+		}
+	}
+	return nil
+}
+`))
+)
+
+// setupBody parses the body size limit of the endpoint
+func setupBody(api *JsonApi) error {
+	if api.MaxBody == "" {
+		return nil
+	}
+	n, err := parseSize(api.MaxBody)
+	if err != nil {
+		return err
+	}
+	api.MaxBodyBytes = n
+	return nil
+}
+
+// KnownParams are the names of params of the endpoint for strict mode
+func (p ApiPoint) KnownParams() string {
+	res := ""
+	for ix, f := range p.InParamFields {
+		if ix > 0 {
+			res += ", "
+		}
+		res += fmt.Sprintf("%q", f.ParamName())
+	}
+	return res
+}
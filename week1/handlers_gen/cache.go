@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+var (
+	cacheTmpl = template.Must(template.New("cacheTmpl").Parse(`
+// etagOf is a strong ETag of a response body
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// etagMatch reports if If-None-Match of a request matches etag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, el := range strings.Split(ifNoneMatch, ",") {
+		el = strings.TrimPrefix(strings.TrimSpace(el), "W/")
+		if el == "*" || el == etag {
+			return true
+		}
+	}
+	return false
+}
+`))
+)
+
+// setupCache checks caching options of the endpoint
+func setupCache(api *JsonApi) error {
+	if api.Cache == "" {
+		return nil
+	}
+	if api.Method != "" && api.Method != "GET" {
+		return fmt.Errorf("only GET endpoints can be cached")
+	}
+	d, err := time.ParseDuration(api.Cache)
+	if err != nil || d < time.Second {
+		return fmt.Errorf("cache %q must be a duration of a second or more", api.Cache)
+	}
+	api.CacheSeconds = int(d / time.Second)
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+type ClientData struct {
+	Package   string
+	Types     []string
+	Receivers map[string][]ApiPoint
+}
+
+var (
+	clientTmpl = template.Must(template.New("clientTmpl").Funcs(template.FuncMap{
+		"paramName":    paramName,
+		"clientMethod": clientMethod,
+	}).Parse(`package {{ .Package }}
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ApiError is returned when the server answers with an error
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	// Code is the stable code of the error, validation errors have validation.<rule> ones
+	Code    string
+	Details map[string]interface{}
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+{{- range $ix, $t := .Types }}
+
+type {{ $t }}
+{{- end }}
+
+type envelope struct {
+	Error    string                 ` + "`json:\"error\"`" + `
+	Code     string                 ` + "`json:\"code\"`" + `
+	Details  map[string]interface{} ` + "`json:\"details\"`" + `
+	Response json.RawMessage        ` + "`json:\"response\"`" + `
+}
+
+func call(ctx context.Context, hc *http.Client, method, u string, v url.Values, auth string, out interface{}) error {
+	var (
+		req *http.Request
+		err error
+	)
+	if method == http.MethodGet {
+		req, err = http.NewRequestWithContext(ctx, method, u+"?"+v.Encode(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, u, strings.NewReader(v.Encode()))
+	}
+	if err != nil {
+		return err
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if auth != "" {
+		req.Header.Set("X-Auth", auth)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	env := envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return ApiError{
+			HTTPStatus: resp.StatusCode,
+			Err:        fmt.Errorf("bad response: %v", err),
+		}
+	}
+	if resp.StatusCode != http.StatusOK || env.Error != "" {
+		return ApiError{
+			HTTPStatus: resp.StatusCode,
+			Err:        errors.New(env.Error),
+			Code:       env.Code,
+			Details:    env.Details,
+		}
+	}
+	return json.Unmarshal(env.Response, out)
+}
+
+{{- range $receiver, $points := .Receivers }}
+
+// {{ $receiver }}Client calls {{ $receiver }} over http
+type {{ $receiver }}Client struct {
+	BaseURL    string
+	Auth       string
+	HTTPClient *http.Client
+}
+
+func New{{ $receiver }}Client(baseURL, auth string) *{{ $receiver }}Client {
+	return &{{ $receiver }}Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Auth:       auth,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+{{- range $ix, $point := $points }}
+{{ with $point.Json.Deprecated }}
+// Deprecated: {{ $point.Json.Url }} goes away{{ if .Sunset }} on {{ .Sunset }}{{ end }}{{ if .Replacement }}, use {{ .Replacement }} instead{{ end }}.
+{{- end }}
+func (c *{{ $receiver }}Client) {{ $point.Method }}(ctx context.Context, in {{ $point.InParam }}) (*{{ $point.OutParam }}, error) {
+	v := url.Values{}
+	{{- range $ix, $f := $point.InParamFields }}
+	{{- if eq $f.Type "string" }}
+	v.Set("{{ $f | paramName }}", in.{{ $f.Name }})
+	{{- else }}
+	v.Set("{{ $f | paramName }}", fmt.Sprint(in.{{ $f.Name }}))
+	{{- end }}
+	{{- end }}
+	out := &{{ $point.OutParam }}{}
+	{{- if $point.Json.Auth }}
+	err := call(ctx, c.HTTPClient, "{{ $point | clientMethod }}", c.BaseURL+"{{ $point.Json.Url }}", v, c.Auth, out)
+	{{- else }}
+	err := call(ctx, c.HTTPClient, "{{ $point | clientMethod }}", c.BaseURL+"{{ $point.Json.Url }}", v, "", out)
+	{{- end }}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+{{- end }}
+{{- end }}
+`))
+)
+
+// clientMethod is the http method used by clients, GET if the endpoint accepts any
+func clientMethod(p ApiPoint) string {
+	if p.Json.Method != "" {
+		return p.Json.Method
+	}
+	return "GET"
+}
+
+func genClient(dir string, fset *token.FileSet, node *ast.File, funcDecl map[string][]ApiPoint) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Can not create %s: %v", dir, err)
+	}
+	data := ClientData{
+		Package:   filepath.Base(dir),
+		Types:     printTypes(fset, node, usedTypes(node, funcDecl)),
+		Receivers: funcDecl,
+	}
+	out := &bytes.Buffer{}
+	if err := clientTmpl.Execute(out, data); err != nil {
+		log.Fatalf("Can not generate client: %v", err)
+	}
+	writeSource(filepath.Join(dir, "client.go"), out.Bytes())
+}
+
+// usedTypes collects params and results types of api points and all types they refer to
+func usedTypes(node *ast.File, funcDecl map[string][]ApiPoint) map[string]bool {
+	types := findTypeSpecs(node)
+	res := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		ts, ok := types[name]
+		if !ok || res[name] {
+			return
+		}
+		res[name] = true
+		ast.Inspect(ts.Type, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				walk(id.Name)
+			}
+			return true
+		})
+	}
+	for _, points := range funcDecl {
+		for _, p := range points {
+			walk(p.InParam)
+			walk(p.OutParam)
+		}
+	}
+	return res
+}
+
+// printTypes prints declarations of the given types in order of the source file
+func printTypes(fset *token.FileSet, node *ast.File, names map[string]bool) []string {
+	res := make([]string, 0)
+	for _, el := range node.Decls {
+		d, ok := el.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range d.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || !names[ts.Name.Name] {
+				continue
+			}
+			buf := &bytes.Buffer{}
+			printer.Fprint(buf, fset, ts)
+			res = append(res, buf.String())
+		}
+	}
+	return res
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"text/template"
 )
 
 const (
-	API_MARKER = "apigen:api"
+	API_MARKER     = "apigen:api"
+	SERVICE_MARKER = "apigen:service"
 )
 
 type ApiPoint struct {
@@ -21,8 +27,14 @@ type ApiPoint struct {
 	Method        string
 	Params        []*ast.Field
 	InParam       string
+	OutParam      string
+	OutType       string
 	InParamFields []StructField
 	Json          *JsonApi
+	// Callback is set for stream methods taking send func(ItemType) error,
+	// other stream methods return <-chan ItemType
+	Callback bool
+	ItemType string
 }
 
 type ApiParam struct {
@@ -31,9 +43,42 @@ type ApiParam struct {
 }
 
 type JsonApi struct {
-	Url    string
-	Auth   bool
-	Method string
+	Url string
+	// Route is the url relative to the prefix of the service, Url includes the prefix
+	Route  string `json:"-"`
+	Prefix string `json:"-"`
+	// Batch is set when the service serves <prefix>/_batch
+	Batch bool `json:"-"`
+	// HandlerField is the field of the receiver keeping its handler
+	HandlerField string `json:"-"`
+	Auth         bool
+	Method       string
+	Middleware   []string
+	Rate         string
+	Burst        int
+	Key          string
+	RatePerSec   float64 `json:"-"`
+	Cache        string
+	CacheSeconds int `json:"-"`
+	Idempotent   bool
+	MaxBody      string `json:"max_body"`
+	MaxBodyBytes int64  `json:"-"`
+	// Strict rejects params the endpoint does not know
+	Strict     bool
+	Stream     string
+	Cors       *CorsApi
+	Version    string
+	Deprecated *DeprecatedApi
+}
+
+// ServiceApi are settings of a receiver from its apigen:service annotation,
+// Defaults are inherited by its endpoints
+type ServiceApi struct {
+	Prefix string
+	// Mount is where NewRouter puts the prefix
+	Mount    string
+	Batch    bool
+	Defaults JsonApi
 }
 
 type StructField struct {
@@ -51,84 +96,404 @@ type Validator struct {
 }
 
 var (
-	codeTmpl = template.Must(template.New("codeTmpl").Parse(`
+	codeTmpl = template.Must(template.New("codeTmpl").Funcs(template.FuncMap{
+		"pointMethods": pointMethods,
+		"versions":     versions,
+		"middlewares":  middlewares,
+		"batchMaxBody": batchMaxBody,
+	}).Parse(`
 {{- range $receiver, $apiPoints := . }}
-func (h *{{ $receiver }} ) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
+// {{ $receiver }}Service is the set of {{ $receiver }} methods served over http
+type {{ $receiver }}Service interface {
 {{- range $ix, $point := $apiPoints }}
-	case "{{ $point.Json.Url }}":
-		h.handler{{ $point.Method }}(w, r)
+	{{ $point.Method }}{{ $point.Signature }}
 {{- end }}
-	default:
+}
+
+// {{ $receiver }}Handler serves any {{ $receiver }}Service implementation
+type {{ $receiver }}Handler struct {
+	Service {{ $receiver }}Service
+	// Prefix is the path the endpoints are mounted at, routes are matched relative to it
+	Prefix string
+	// AccessLog gets a json line per request, it is off while nil
+	AccessLog *log.Logger
+	// Idempotency keeps responses of idempotent endpoints for IdempotencyTTL
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	// CORS is the policy of endpoints without one in their annotation,
+	// nil forbids calls from other origins
+	CORS           *CORSPolicy
+	cors           map[string]*CORSPolicy
+	mu             sync.RWMutex
+	middlewares    map[string]func(http.Handler) http.Handler
+	// chains are endpoints wrapped into their middlewares, nil until the first request
+	chains         map[string]http.Handler
+	metrics        *apigenMetrics
+	idempotency    *apigenIdempotency
+{{- if (index $apiPoints 0).Json.Batch }}
+	// MaxBatch is the most requests a batch may have, BatchConcurrency
+	// is how many of them run at once
+	MaxBatch         int
+	BatchConcurrency int
+	// MaxBatchBody is the most bytes a batch body may have, 0 is no limit.
+	// It defaults to the largest max_body of the endpoints.
+	MaxBatchBody int64
+{{- end }}
+{{- range $ix, $point := $apiPoints }}
+{{- if $point.Json.Rate }}
+	limiter{{ $point.Method }} *rateLimiter
+{{- end }}
+{{- end }}
+}
+
+func New{{ $receiver }}Handler(svc {{ $receiver }}Service) *{{ $receiver }}Handler {
+	return &{{ $receiver }}Handler{
+		Service:        svc,
+		Prefix:         "{{ (index $apiPoints 0).Json.Prefix }}",
+		Idempotency:    NewMemoryIdempotencyStore(),
+		IdempotencyTTL: 24 * time.Hour,
+		middlewares:    make(map[string]func(http.Handler) http.Handler),
+		metrics:        newApigenMetrics("{{ $receiver }}"),
+		idempotency:    newApigenIdempotency(),
+{{- if (index $apiPoints 0).Json.Batch }}
+		MaxBatch:         20,
+		BatchConcurrency: 4,
+		MaxBatchBody:     {{ batchMaxBody $apiPoints }},
+{{- end }}
+		cors: map[string]*CORSPolicy{
+{{- range $ix, $point := $apiPoints }}
+{{- with $point.Json.Cors }}
+			"{{ $point.Json.RouteKey }}": {
+				AllowOrigins: []string{ {{- range .Origins }}"{{ . }}", {{ end -}} },
+				{{- if .Methods }}
+				AllowMethods: []string{ {{- range .Methods }}"{{ . }}", {{ end -}} },
+				{{- end }}
+				{{- if .Headers }}
+				AllowHeaders: []string{ {{- range .Headers }}"{{ . }}", {{ end -}} },
+				{{- end }}
+				{{- if .ExposeHeaders }}
+				ExposeHeaders: []string{ {{- range .ExposeHeaders }}"{{ . }}", {{ end -}} },
+				{{- end }}
+				{{- if .Credentials }}
+				AllowCredentials: true,
+				{{- end }}
+				{{- if .MaxAgeSeconds }}
+				MaxAge: {{ .MaxAgeSeconds }} * time.Second,
+				{{- end }}
+			},
+{{- end }}
+{{- end }}
+		},
+{{- range $ix, $point := $apiPoints }}
+{{- if $point.Json.Rate }}
+		limiter{{ $point.Method }}: newRateLimiter({{ $point.Json.RatePerSec }}, {{ $point.Json.Burst }}),
+{{- end }}
+{{- end }}
+	}
+}
+
+{{- with (index $apiPoints 0).Json.HandlerField }}
+
+// Handler returns the handler kept in h.{{ . }}, the constructor of
+// {{ $receiver }} makes it with New{{ $receiver }}Handler
+func (h *{{ $receiver }}) Handler() *{{ $receiver }}Handler {
+	return h.{{ . }}
+}
+
+// ServeHTTP serves h with its Handler, which keeps middlewares, limits
+// and metrics between requests
+func (h *{{ $receiver }}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.{{ . }} == nil {
+		log.Print("{{ $receiver }}: handler is not set, make it with New{{ $receiver }}Handler")
+		writeError(w, r, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	h.{{ . }}.ServeHTTP(w, r)
+}
+{{- end }}
+
+var middlewares{{ $receiver }} = []string{ {{- range middlewares $apiPoints }}"{{ . }}", {{ end -}} }
+
+// RegisterMiddleware makes mw available to endpoints listing name in their
+// "middleware" annotation
+func (h *{{ $receiver }}Handler) RegisterMiddleware(name string, mw func(http.Handler) http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.middlewares[name] = mw
+	h.chains = nil
+}
+
+// Check reports middlewares listed in annotations but not registered,
+// endpoints using them answer with internal errors
+func (h *{{ $receiver }}Handler) Check() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.check()
+}
+
+func (h *{{ $receiver }}Handler) check() error {
+	missing := make([]string, 0)
+	for _, name := range middlewares{{ $receiver }} {
+		if _, ok := h.middlewares[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("{{ $receiver }}: middleware %s is not registered", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// MetricsHandler serves metrics of the endpoints in prometheus text format,
+// they are also available at <prefix>/_meta/metrics
+func (h *{{ $receiver }}Handler) MetricsHandler() http.Handler {
+	return h.metrics
+}
+
+// endpoint returns the endpoint at key wrapped into its middlewares, nil if
+// one of them is not registered. Chains are built once middlewares change.
+func (h *{{ $receiver }}Handler) endpoint(key string) http.Handler {
+	h.mu.RLock()
+	chains := h.chains
+	h.mu.RUnlock()
+	if chains == nil {
+		chains = h.buildChains()
+	}
+	return chains[key]
+}
+
+func (h *{{ $receiver }}Handler) buildChains() map[string]http.Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.chains != nil {
+		return h.chains
+	}
+	if err := h.check(); err != nil {
+		log.Print(err)
+	}
+	h.chains = make(map[string]http.Handler)
+	{{- range $ix, $point := $apiPoints }}
+	{{- if $point.Json.Middleware }}
+	h.chains["{{ $point.Json.RouteKey }}"] = h.chain(http.HandlerFunc(h.handler{{ $point.Method }}){{ range $point.Json.Middleware }}, "{{ . }}"{{ end }})
+	{{- end }}
+	{{- end }}
+	return h.chains
+}
+
+// chain wraps next into the named middlewares, the first one is the outermost.
+// Middlewares run before the auth, method and params checks of the endpoint.
+func (h *{{ $receiver }}Handler) chain(next http.Handler, names ...string) http.Handler {
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, ok := h.middlewares[names[i]]
+		if !ok {
+			return nil
+		}
+		next = mw(next)
+	}
+	return next
+}
+
+var versions{{ $receiver }} = []string{ {{- range versions $apiPoints }}"{{ . }}", {{ end -}} }
+
+var routeMethods{{ $receiver }} = map[string][]string{
+{{- range $ix, $point := $apiPoints }}
+	"{{ $point.Json.RouteKey }}": { {{- range pointMethods $point }}"{{ . }}", {{ end -}} },
+{{- end }}
+	"/_meta/routes":       {"GET"},
+	"/_meta/openapi.json": {"GET"},
+	"/_meta/metrics":      {"GET"},
+{{- if (index $apiPoints 0).Json.Batch }}
+	"/_batch": {"POST"},
+{{- end }}
+}
+
+func (h *{{ $receiver }}Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, path := splitVersion(r.URL.Path, versions{{ $receiver }})
+	if strings.HasPrefix(path, h.Prefix) {
+		path = version + path[len(h.Prefix):]
+	} else {
+		path = ""
+	}
+	h.serve(w, r, path)
+}
+
+// RegisterRoutes mounts the endpoints and meta paths of h at prefix in mux,
+// the prefix is used instead of h.Prefix. Versioned endpoints go to /<version><prefix>.
+// It fails if h misses middlewares, they must be registered before.
+func (h *{{ $receiver }}Handler) RegisterRoutes(mux *http.ServeMux, prefix string) error {
+	if err := h.Check(); err != nil {
+		return err
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, path := splitVersion(r.URL.Path, versions{{ $receiver }})
+		h.serve(w, r, version+strings.TrimPrefix(path, prefix))
+	})
+	for key := range routeMethods{{ $receiver }} {
+		version, route := splitVersion(key, versions{{ $receiver }})
+		mux.Handle(version+prefix+route, serve)
+	}
+	return nil
+}
+
+// serve handles the request to path, it is the version and the url relative to the prefix
+func (h *{{ $receiver }}Handler) serve(w http.ResponseWriter, r *http.Request, path string) {
+	if methods, ok := routeMethods{{ $receiver }}[path]; ok {
+		policy := h.CORS
+		if p, ok := h.cors[path]; ok {
+			policy = p
+		}
+		if serveCORS(w, r, policy, methods) {
+			return
+		}
+	}
+	switch path {
+{{- range $ix, $point := $apiPoints }}
+	case "{{ $point.Json.RouteKey }}":
+		call, r := beginCall(w, r, "{{ $point.Json.Url }}", h.metrics, h.AccessLog)
+		defer call.end()
+		defer recoverPanic(call, r, "{{ $receiver }}.{{ $point.Method }}")
+		{{- with $point.Json.Deprecated }}
+		setDeprecated(call, "{{ .SunsetHeader }}", "{{ .Replacement }}")
+		h.metrics.deprecatedCall("{{ $point.Json.Url }}")
+		{{- end }}
+		{{- if $point.Json.Middleware }}
+		if next := h.endpoint("{{ $point.Json.RouteKey }}"); next != nil {
+			next.ServeHTTP(call, r)
+		} else {
+			// the missing middleware is logged once, Check tells about it
+			setResult(r, "error")
+			writeError(call, r, http.StatusInternalServerError, "internal", "internal error")
+		}
+		{{- else }}
+		h.handler{{ $point.Method }}(call, r)
+		{{- end }}
+{{- end }}
+	case "/_meta/routes":
 		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unknown method",}
-		body, _ := json.Marshal(res)
+		w.Write([]byte(routes{{ $receiver }}))
+	case "/_meta/openapi.json":
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write(body)
+		w.Write([]byte(openapi{{ $receiver }}))
+	case "/_meta/metrics":
+		h.metrics.ServeHTTP(w, r)
+{{- if (index $apiPoints 0).Json.Batch }}
+	case "/_batch":
+		// urls of the batch are relative to where the batch is served
+		prefix := strings.TrimSuffix(r.URL.Path, "/_batch")
+		serveBatch(w, r, h.MaxBatch, h.BatchConcurrency, h.MaxBatchBody, func(w http.ResponseWriter, r *http.Request) {
+			version, path := splitVersion(r.URL.Path, versions{{ $receiver }})
+			key := ""
+			if strings.HasPrefix(path, prefix) {
+				key = version + path[len(prefix):]
+			}
+			if key == "/_batch" {
+				// batches do not nest
+				key = ""
+			}
+			h.serve(w, r, key)
+		})
+{{- end }}
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "unknown method")
 		return
 	}
 }
 
 {{- range $ix, $point := $apiPoints }}
-func (h *{{ $receiver }} ) handler{{ $point.Method }}(w http.ResponseWriter, r *http.Request) {
+func (h *{{ $receiver }}Handler) handler{{ $point.Method }}(w http.ResponseWriter, r *http.Request) {
+	{{- if not $point.Json.Stream }}
+	// 0. формат ответа, text годится только для ошибок
+	if _, ok := negotiate(r.Header.Get("Accept"), true); !ok {
+		writeError(w, r, http.StatusNotAcceptable, "not_acceptable", "not acceptable")
+		return
+	}
+	{{- end }}
+	{{- if and $point.Json.Rate (eq $point.Json.Key "ip") }}
+	// 0. ограничение частоты запросов
+	if ok, wait := h.limiter{{ $point.Method }}.allow(rateKeyIP(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests")
+		return
+	}
+	{{- end }}
 	{{- if $point.Json.Auth }}
 	// 1. проверка авторизации
 	if h, ok := r.Header["X-Auth"]; ok {
 		if h[0] != "100500" {
-			w.Header().Set("Content-Type", "application/json")
-			res := map[string]string{"error": "unauthorized",}
-			body, _ := json.Marshal(res)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			w.Write(body)
+			writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
 			return
 		}
 	} else {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "unauthorized",}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write(body)
+		writeError(w, r, http.StatusForbidden, "unauthorized", "unauthorized")
+		return
+	}
+	{{- end }}
+	{{- if and $point.Json.Rate (eq $point.Json.Key "auth") }}
+	// 1.1 ограничение частоты запросов по проверенному токену
+	if ok, wait := h.limiter{{ $point.Method }}.allow(rateKeyAuth(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests")
 		return
 	}
 	{{- end }}
 	{{- if $point.Json.Method }}
 	// 2. проверки метода (GET/POST)
-	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": "bad method",}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write(body)
+	if r.Method != "{{ $point.Json.Method }}" {
+		writeError(w, r, http.StatusNotAcceptable, "method_not_allowed", "bad method")
+		return
+	}
+	{{- end }}
+	{{- if or $point.Json.MaxBody $point.Json.Strict }}
+	// 2.1 размер тела и неизвестные параметры
+	{{- if $point.Json.MaxBody }}
+	r.Body = http.MaxBytesReader(w, r.Body, {{ $point.Json.MaxBodyBytes }})
+	{{- end }}
+	if vErr := readForm(r); vErr != nil {
+		setResult(r, "invalid")
+		writeApiError(w, r, vErr)
+		return
+	}
+	{{- if $point.Json.Strict }}
+	if vErr := checkParams(r, {{ $point.KnownParams }}); vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	{{- end }}
+	{{- end }}
+	{{- if $point.Json.Idempotent }}
+	// 2.2 повтор запроса с тем же Idempotency-Key
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		iw, done := h.idempotency.begin(w, r, h.Idempotency, h.IdempotencyTTL, "{{ $point.Json.Url }}", key)
+		if done {
+			return
+		}
+		defer iw.finish()
+		w = iw
+	}
+	{{- end }}
 	// 3. заполнение структуры params
 	var vErr *ApiError
 	{{- range $ix, $f :=  $point.InParamFields }}
-	{{- if $f.CustomName }}
+	{{- if $f.IsFile }}
+	val{{ $f.Name }}, vErr := FillFile("{{ $f.ParamName }}", "{{ $f.Type }}", r)
+	if vErr != nil {
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
+		return
+	}
+	{{- else if $f.CustomName }}
 	val{{ $f.Name }}, vErr := FillValue("{{ $f.CustomName }}", "{{ $f.Type }}", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error(),}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	{{- else }}
 	val{{ $f.Name }}, vErr := FillValue("{{ $f.Name }}", "{{ $f.Type }}", r)
 	if vErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": vErr.Error(),}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(vErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, vErr)
+		writeApiError(w, r, vErr)
 		return
 	}
 	{{- end }}
@@ -139,43 +504,91 @@ func (h *{{ $receiver }} ) handler{{ $point.Method }}(w http.ResponseWriter, r *
 		{{- end }}
 	}
 	// 4. валидирование параметров
-	valErr := Validate{{ $point.InParam }}(params)
+	valErr := Validate{{ $point.InParam }}(&params)
 	if valErr != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": valErr.Error(),}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(valErr.HTTPStatus)
-		w.Write(body)
+		setInvalid(r, valErr)
+		writeApiError(w, r, valErr)
 		return
 	}
-	ctx := context.Background()
-	answer, err := h.{{ $point.Method }}(ctx, params)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		res := map[string]string{"error": err.Error(),}
-		body, _ := json.Marshal(res)
-		w.Header().Set("Content-Type", "application/json")
-		if err, ok := err.(ApiError); ok {
-			w.WriteHeader(err.HTTPStatus)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+	ctx := r.Context()
+	{{- if $point.Json.Stream }}
+	stream := newApigenStream(w, r, "{{ $point.Json.Stream }}")
+	{{- if $point.Callback }}
+	err := h.Service.{{ $point.Method }}(ctx, params, func(item {{ $point.ItemType }}) error {
+		return stream.send(item)
+	})
+	{{- else }}
+	items, err := h.Service.{{ $point.Method }}(ctx, params)
+	if err == nil {
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				break loop
+			case item, ok := <-items:
+				if !ok {
+					break loop
+				}
+				if err = stream.send(item); err != nil {
+					break loop
+				}
+			}
 		}
-		w.Write(body)
+	}
+	{{- end }}
+	stream.end(err)
+	{{- else }}
+	answer, err := h.Service.{{ $point.Method }}(ctx, params)
+	if err != nil {
+		setResult(r, "error")
+		writeApiError(w, r, err)
 		return
 	}
-	res := map[string]interface{}{
-		"error": "",
-		"response": answer,
-	}	
-	body, _ := json.Marshal(res)
-	w.Header().Set("Content-Type", "application/json")
+	body, contentType := encodeResponse(r, answer)
+	{{- if $point.Json.Cache }}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		etag := etagOf(body)
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("ETag", etag)
+		{{- if $point.Json.Auth }}
+		w.Header().Set("Cache-Control", "private, max-age={{ $point.Json.CacheSeconds }}")
+		{{- else }}
+		w.Header().Set("Cache-Control", "public, max-age={{ $point.Json.CacheSeconds }}")
+		{{- end }}
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	{{- end }}
+	w.Header().Set("Content-Type", contentType)
 	w.Write(body)
+	{{- end }}
 	// прочие обработки
 }
 {{- end }}
 
 {{- end }}
+// recoverPanic answers with an internal error if the handler panics,
+// the panic value goes only to the log. A response already started, like
+// a stream, is just ended. http.ErrAbortHandler is panicked on, so that
+// the server aborts the response.
+func recoverPanic(call *apigenCall, r *http.Request, endpoint string) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+	log.Printf("%s panic: %v\n%s", endpoint, rec, debug.Stack())
+	call.result = "panic"
+	if call.status == 0 {
+		writeError(call, r, http.StatusInternalServerError, "internal", "internal error")
+	}
+}
+
 func FillValue(n, t string, r *http.Request) (interface{}, *ApiError){
 	n = strings.ToLower(n)
 	val := r.FormValue(n)
@@ -184,7 +597,7 @@ func FillValue(n, t string, r *http.Request) (interface{}, *ApiError){
 		if err != nil {
 			return 0, &ApiError{
 				HTTPStatus:http.StatusBadRequest,
-				Err:fmt.Errorf("%s must be %s", n, t),
+				Err:newValidationError(n, "type", "type", n, t),
 			}
 		}
 		return res, nil
@@ -196,19 +609,17 @@ func FillValue(n, t string, r *http.Request) (interface{}, *ApiError){
 	validTmpl = template.Must(template.New("validTmpl").Parse(`
 {{- range $k, $v := . }}
 
-func Validate{{ $v.Name }}(param {{ $v.Name }}) *ApiError {
-	var e reflect.Value
+func Validate{{ $v.Name }}(param *{{ $v.Name }}) *ApiError {
 	{{- range $ix, $f := $v.ParamFields }}
 	// validate {{ $f.Name }} field
 	{{- range $ix, $v := $f.Validators }}
 
 	{{- if eq $v.Name "required" }}
 	// validate required status
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	if reflect.Zero(e.Type()).Interface() == e.Interface() {
+	if param.{{ $f.Name }} == {{ if eq $f.Type "string" }}""{{ else if $f.IsFile }}nil{{ else }}0{{ end }} {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s must me not empty", strings.ToLower("{{ $f.Name }}")),
+			Err: newValidationError("{{ $f.ParamName }}", "required", "required", strings.ToLower("{{ $f.Name }}")),
 		}
 	}
 	{{- end }}
@@ -216,19 +627,17 @@ func Validate{{ $v.Name }}(param {{ $v.Name }}) *ApiError {
 	{{- if eq $v.Name "min" }}
 	// validate min value
 	{{- if eq $f.Type "string" }}
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	if len(e.Interface().(string)) < {{ $v.Value }} {
+	if len(param.{{ $f.Name }}) < {{ $v.Value }} {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s len must be >= %d", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
+			Err: newValidationError("{{ $f.ParamName }}", "min", "min_len", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
 		}
 	}
 	{{- else }}
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	if e.Interface().(int) < {{ $v.Value }} {
+	if param.{{ $f.Name }} < {{ $v.Value }} {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s must be >= %d", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
+			Err: newValidationError("{{ $f.ParamName }}", "min", "min", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
 		}
 	}
 	{{- end }}
@@ -237,19 +646,17 @@ func Validate{{ $v.Name }}(param {{ $v.Name }}) *ApiError {
 	{{- if eq $v.Name "max" }}
 	// validate max value
 	{{- if eq $f.Type "string" }}
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	if len(e.Interface().(string)) > {{ $v.Value }} {
+	if len(param.{{ $f.Name }}) > {{ $v.Value }} {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s len must be <= %d", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
+			Err: newValidationError("{{ $f.ParamName }}", "max", "max_len", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
 		}
 	}
 	{{- else }}
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	if e.Interface().(int) > {{ $v.Value }} {
+	if param.{{ $f.Name }} > {{ $v.Value }} {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s must be <= %d", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
+			Err: newValidationError("{{ $f.ParamName }}", "max", "max", strings.ToLower("{{ $f.Name }}"), {{ $v.Value }}),
 		}
 	}
 	{{- end }}
@@ -257,25 +664,48 @@ func Validate{{ $v.Name }}(param {{ $v.Name }}) *ApiError {
 
 	{{- if eq $v.Name "enum" }}
 	// validate enum value
-	enumVal := strings.Split("{{ $v.Value }}", "|")
-	e = reflect.ValueOf(param).FieldByName("{{ $f.Name }}")
-	var findVal bool
-	for _, el :=range enumVal {
-		if el == e.Interface().(string) {
-			findVal = true
+	{{- if $f.Default }}
+	if param.{{ $f.Name }} == "" {
+		param.{{ $f.Name }} = "{{ $f.DefaultVal }}"
+	}
+	{{- end }}
+	enum{{ $f.Name }} := strings.Split("{{ $v.Value }}", "|")
+	var found{{ $f.Name }} bool
+	for _, el := range enum{{ $f.Name }} {
+		if el == param.{{ $f.Name }} {
+			found{{ $f.Name }} = true
 			break
 		}
 	}
-	{{- if $f.Default }}
-	if !findVal && reflect.Zero(e.Type()).Interface() == e.Interface(){
-		param.{{ $f.Name }} = "{{ $f.DefaultVal }}"
-		findVal = true
+	if !found{{ $f.Name }} {
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err: newValidationError("{{ $f.ParamName }}", "enum", "enum", strings.ToLower("{{ $f.Name }}"), strings.Join(enum{{ $f.Name }}, ", ")),
+		}
+	}
+	{{- end }}
+
+	{{- if eq $v.Name "maxsize" }}
+	// validate size of file
+	{{- if eq $f.Type "[]byte" }}
+	if len(param.{{ $f.Name }}) > {{ $v.Size }} {
+	{{- else }}
+	if param.{{ $f.Name }} != nil && param.{{ $f.Name }}.Size > {{ $v.Size }} {
+	{{- end }}
+		return &ApiError{
+			HTTPStatus: http.StatusBadRequest,
+			Err: newValidationError("{{ $f.ParamName }}", "maxsize", "maxsize", strings.ToLower("{{ $f.Name }}"), {{ $v.Size }}),
+		}
 	}
 	{{- end }}
-	if !findVal {
+
+	{{- if eq $v.Name "mimetype" }}
+	// validate mime type of file
+	mime{{ $f.Name }} := strings.Split("{{ $v.Value }}", "|")
+	if param.{{ $f.Name }} != nil && !hasMimeType(param.{{ $f.Name }}, mime{{ $f.Name }}) {
 		return &ApiError{
 			HTTPStatus: http.StatusBadRequest,
-			Err: fmt.Errorf("%s must be one of [%v]", strings.ToLower("{{ $f.Name }}"), strings.Join(enumVal, ", ")),
+			Err: newValidationError("{{ $f.ParamName }}", "mimetype", "mimetype", strings.ToLower("{{ $f.Name }}"), strings.Join(mime{{ $f.Name }}, ", ")),
 		}
 	}
 	{{- end }}
@@ -289,17 +719,31 @@ func Validate{{ $v.Name }}(param {{ $v.Name }}) *ApiError {
 `))
 )
 
+var (
+	openapiDir = flag.String("openapi", "", "directory to write <Receiver>.json OpenAPI documents to")
+	clientDir  = flag.String("client", "", "directory to write go client package to")
+	tsFile     = flag.String("ts", "", "file to write typescript client to")
+	mockFile   = flag.String("mock", "", "file to write mocks of api services to")
+	testsFile  = flag.String("tests", "", "file to write boundary tests of handlers to, needs -mock")
+	fuzzFile   = flag.String("fuzz", "", "file to write fuzz targets of handlers to, needs -mock")
+)
+
 func main() {
-	args := os.Args
-	if len(args) < 3 {
-		fmt.Println("Usage: codegen input.go output.go")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: codegen [flags] input.go output.go")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
 		log.Fatalln("To few arguments")
 	}
-	inputFile := args[1]
+	inputFile := args[0]
 	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
 		log.Fatalf("File %s does not exists", inputFile)
 	}
-	outputFile := args[2]
+	outputFile := args[1]
 	genapi(inputFile, outputFile)
 }
 
@@ -309,10 +753,37 @@ func genapi(in, out string) {
 	if err != nil {
 		log.Fatalln("Can not parse go source")
 	}
-	funcDecl := findFuncDecl(node)
+	services := findServices(node)
+	funcDecl := findFuncDecl(node, services)
+	if err := setHandlerFields(node, funcDecl); err != nil {
+		log.Fatalf("Can not generate handlers: %v", err)
+	}
+	mounts, err := buildRouter(funcDecl, services)
+	if err != nil {
+		log.Fatalf("Can not generate router: %v", err)
+	}
 	paramsStructNames := getParamsStructNames(funcDecl)
 	structDecl := findStructDecl(node, paramsStructNames)
-	genOutput(out, node, funcDecl, structDecl)
+	meta := buildMeta(funcDecl, findTypeSpecs(node))
+	if *openapiDir != "" {
+		genOpenAPIFiles(*openapiDir, meta)
+	}
+	if *clientDir != "" {
+		genClient(*clientDir, fset, node, restPoints(funcDecl))
+	}
+	if *tsFile != "" {
+		genTypeScript(*tsFile, node, restPoints(funcDecl))
+	}
+	if *mockFile != "" {
+		genMock(*mockFile, node, funcDecl)
+	}
+	if *testsFile != "" {
+		genTests(*testsFile, node, funcDecl)
+	}
+	if *fuzzFile != "" {
+		genFuzz(*fuzzFile, node, funcDecl)
+	}
+	genOutput(out, node, funcDecl, structDecl, meta, mounts)
 }
 func getParamsStructNames(funcDecl map[string][]ApiPoint) map[string]int {
 	res := make(map[string]int)
@@ -336,6 +807,14 @@ func findStructDecl(node *ast.File, paramsStructNames map[string]int) map[string
 					Name:        structDecl.Name.Name,
 					ParamFields: getStructFields2(structDecl),
 				}
+				for _, f := range p.ParamFields {
+					if err := checkFieldType(p.Name, f); err != nil {
+						log.Fatal(err)
+					}
+					if err := checkFileValidators(p.Name, f); err != nil {
+						log.Fatal(err)
+					}
+				}
 				res[structDecl.Name.Name] = p
 			}
 		}
@@ -343,12 +822,11 @@ func findStructDecl(node *ast.File, paramsStructNames map[string]int) map[string
 	return res
 }
 
-func findFuncDecl(node *ast.File) map[string][]ApiPoint {
+func findFuncDecl(node *ast.File, services map[string]ServiceApi) map[string][]ApiPoint {
 	res := make(map[string][]ApiPoint)
 	for _, el := range node.Decls {
 		if v, ok := el.(*ast.FuncDecl); ok {
 			if ok, comment := isGenApi(v); ok {
-				getJsonApi(comment)
 				exp := v.Recv.List[0].Type.(*ast.StarExpr)
 				name := exp.X.(*ast.Ident).Name
 				apiPoint := ApiPoint{
@@ -356,8 +834,26 @@ func findFuncDecl(node *ast.File) map[string][]ApiPoint {
 					Method:        v.Name.Name,
 					Params:        v.Type.Params.List,
 					InParam:       getParamType(v.Type.Params.List[1]),
+					OutType:       exprString(v.Type.Results.List[0].Type),
 					InParamFields: getStructFields(v.Type.Params.List[1]),
-					Json:          getJsonApi(comment),
+					Json:          getJsonApi(comment, services[name]),
+				}
+				if apiPoint.HasFiles() && apiPoint.Json.Method != "POST" {
+					log.Fatalf("%s.%s takes files, it must be POST", name, v.Name.Name)
+				}
+				callback, item := streamShape(v)
+				if item != nil {
+					if apiPoint.Json.Stream == "" {
+						log.Fatalf("%s.%s streams items, it needs stream in annotation", name, v.Name.Name)
+					}
+					apiPoint.Callback = callback
+					apiPoint.ItemType = exprString(item)
+					apiPoint.OutParam = typeName(item)
+				} else {
+					if apiPoint.Json.Stream != "" {
+						log.Fatalf("%s.%s must return <-chan T or take send func(T) error to stream", name, v.Name.Name)
+					}
+					apiPoint.OutParam = getResultType(v.Type.Results.List[0])
 				}
 				if pointList, ok := res[name]; ok {
 					res[name] = append(pointList, apiPoint)
@@ -370,16 +866,34 @@ func findFuncDecl(node *ast.File) map[string][]ApiPoint {
 	return res
 }
 
+// checkFieldType makes sure params are of types the handlers can fill
+func checkFieldType(structName string, f StructField) error {
+	switch f.Type {
+	case "string", "int", "*multipart.FileHeader", "[]byte":
+		return nil
+	}
+	return fmt.Errorf("%s.%s: params of type %s are not supported, use string, int, *multipart.FileHeader or []byte",
+		structName, f.Name, f.Type)
+}
+
+// ParamName is the name under which the field is read from the request
+func (f StructField) ParamName() string {
+	return paramName(f)
+}
+
 func getStructFields(s *ast.Field) []StructField {
 	fields := s.Type.(*ast.Ident).Obj.Decl.(*ast.TypeSpec).Type.(*ast.StructType).Fields.List
 	res := make([]StructField, len(fields))
 	for ix, f := range fields {
 		name := f.Names[0].Name
-		tag := f.Tag.Value
+		tag := ""
+		if f.Tag != nil {
+			tag = f.Tag.Value
+		}
 		v, cn, isD, d := parseValidators(tag)
 		sf := StructField{
 			Name:       name,
-			Type:       f.Type.(*ast.Ident).Name,
+			Type:       exprString(f.Type),
 			CustomName: cn,
 			Default:    isD,
 			DefaultVal: d,
@@ -404,7 +918,7 @@ func getStructFields2(s *ast.TypeSpec) []StructField {
 		v, cn, isD, d := parseValidators(tag)
 		sf := StructField{
 			Name:       name,
-			Type:       f.Type.(*ast.Ident).Name,
+			Type:       exprString(f.Type),
 			CustomName: cn,
 			Default:    isD,
 			DefaultVal: d,
@@ -453,32 +967,249 @@ func isGenApi(decl *ast.FuncDecl) (bool, string) {
 	return false, ""
 }
 
-func getJsonApi(comment string) *JsonApi {
-	res := &JsonApi{}
+// findServices reads apigen:service annotations of types
+func findServices(node *ast.File) map[string]ServiceApi {
+	res := make(map[string]ServiceApi)
+	for _, el := range node.Decls {
+		d, ok := el.(*ast.GenDecl)
+		if !ok || d.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range d.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(d.Specs) == 1 {
+				doc = d.Doc
+			}
+			if doc == nil {
+				continue
+			}
+			for _, c := range doc.List {
+				if !strings.Contains(c.Text, SERVICE_MARKER) {
+					continue
+				}
+				jsonStr := c.Text[strings.Index(c.Text, "{"):]
+				svc := ServiceApi{}
+				if err := json.Unmarshal([]byte(jsonStr), &svc); err != nil {
+					log.Fatalf("Wrong json in service comment of %s", ts.Name.Name)
+				}
+				if err := json.Unmarshal([]byte(jsonStr), &svc.Defaults); err != nil {
+					log.Fatalf("Wrong json in service comment of %s", ts.Name.Name)
+				}
+				if svc.Prefix != "" && (!strings.HasPrefix(svc.Prefix, "/") || strings.HasSuffix(svc.Prefix, "/")) {
+					log.Fatalf("Prefix of %s must start and must not end with /", ts.Name.Name)
+				}
+				if svc.Mount != "" && (!strings.HasPrefix(svc.Mount, "/") || strings.HasSuffix(svc.Mount, "/")) {
+					log.Fatalf("Mount of %s must start and must not end with /", ts.Name.Name)
+				}
+				if svc.Defaults.Url != "" {
+					log.Fatalf("Service comment of %s can not set url", ts.Name.Name)
+				}
+				res[ts.Name.Name] = svc
+			}
+		}
+	}
+	return res
+}
+
+// setHandlerFields finds fields of receivers keeping their *<Receiver>Handler,
+// every receiver needs one: the handler keeps middlewares, rate limits,
+// idempotency and metrics between requests
+func setHandlerFields(node *ast.File, funcDecl map[string][]ApiPoint) error {
+	types := findTypeSpecs(node)
+	for _, receiver := range sortedKeys(funcDecl) {
+		field := ""
+		if ts, ok := types[receiver]; ok {
+			if st, ok := ts.Type.(*ast.StructType); ok {
+				for _, f := range st.Fields.List {
+					if exprString(f.Type) == "*"+receiver+"Handler" && len(f.Names) == 1 {
+						field = f.Names[0].Name
+					}
+				}
+			}
+		}
+		if field == "" {
+			return fmt.Errorf("%s needs a field of type *%sHandler to keep its handler", receiver, receiver)
+		}
+		for _, p := range funcDecl[receiver] {
+			p.Json.HandlerField = field
+		}
+	}
+	return nil
+}
+
+// middlewares returns the names of middlewares used by the endpoints
+func middlewares(points []ApiPoint) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0)
+	for _, p := range points {
+		for _, name := range p.Json.Middleware {
+			if !seen[name] {
+				seen[name] = true
+				res = append(res, name)
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// clone copies the settings so that unmarshaling into the copy keeps them intact
+func (a JsonApi) clone() *JsonApi {
+	if a.Middleware != nil {
+		a.Middleware = append([]string{}, a.Middleware...)
+	}
+	if a.Deprecated != nil {
+		deprecated := *a.Deprecated
+		a.Deprecated = &deprecated
+	}
+	if a.Cors != nil {
+		cors := *a.Cors
+		cors.Origins = append([]string{}, cors.Origins...)
+		cors.Methods = append([]string{}, cors.Methods...)
+		cors.Headers = append([]string{}, cors.Headers...)
+		cors.ExposeHeaders = append([]string{}, cors.ExposeHeaders...)
+		a.Cors = &cors
+	}
+	return &a
+}
+
+// getJsonApi reads the annotation of an endpoint over the defaults of its service
+func getJsonApi(comment string, svc ServiceApi) *JsonApi {
+	res := svc.Defaults.clone()
 	jsonStr := comment[strings.Index(comment, "{"):]
 	err := json.Unmarshal([]byte(jsonStr), res)
 	if err != nil {
 		log.Fatalln("Wrong json in comments")
 	}
+	if !strings.HasPrefix(res.Url, "/") {
+		log.Fatalf("Url %q must start with /", res.Url)
+	}
+	res.Route = res.Url
+	res.Prefix = svc.Prefix
+	res.Batch = svc.Batch
+	res.Url = svc.Prefix + res.Url
+	if res.Version != "" {
+		res.Url = "/" + res.Version + res.Url
+	}
+	if err := setupRate(res); err != nil {
+		log.Fatalf("Wrong rate limit of %s: %v", res.Url, err)
+	}
+	if err := setupCache(res); err != nil {
+		log.Fatalf("Wrong cache of %s: %v", res.Url, err)
+	}
+	if err := setupIdempotent(res); err != nil {
+		log.Fatalf("Wrong idempotency of %s: %v", res.Url, err)
+	}
+	if err := setupCors(res); err != nil {
+		log.Fatalf("Wrong cors of %s: %v", res.Url, err)
+	}
+	if err := setupStream(res); err != nil {
+		log.Fatalf("Wrong stream of %s: %v", res.Url, err)
+	}
+	if err := setupBody(res); err != nil {
+		log.Fatalf("Wrong max_body of %s: %v", res.Url, err)
+	}
+	if err := setupVersion(res); err != nil {
+		log.Fatalf("Wrong version of %s: %v", res.Url, err)
+	}
 	return res
 }
 
-func genOutput(outputFile string, node *ast.File, funcDecl map[string][]ApiPoint, structDecl map[string]ApiParam) {
-	out, _ := os.Create(os.Args[2])
-	defer out.Close()
+func genOutput(outputFile string, node *ast.File, funcDecl map[string][]ApiPoint, structDecl map[string]ApiParam, meta map[string]ApiMeta, mounts []RouterMount) {
+	out := &bytes.Buffer{}
 	fmt.Fprintln(out, `package `+node.Name.Name)
 	fmt.Fprintln(out)
 	fmt.Fprintln(out, `import "net/http"`)
 	fmt.Fprintln(out, `import "encoding/json"`)
 	fmt.Fprintln(out, `import "context"`)
-	fmt.Fprintln(out, `import "reflect"`)
 	fmt.Fprintln(out, `import "fmt"`)
 	fmt.Fprintln(out, `import "strings"`)
 	fmt.Fprintln(out, `import "strconv"`)
+	fmt.Fprintln(out, `import "log"`)
+	fmt.Fprintln(out, `import "runtime/debug"`)
+	fmt.Fprintln(out, `import "sync"`)
+	fmt.Fprintln(out, `import "time"`)
+	fmt.Fprintln(out, `import "math"`)
+	fmt.Fprintln(out, `import "net"`)
+	fmt.Fprintln(out, `import "sort"`)
+	fmt.Fprintln(out, `import "crypto/rand"`)
+	fmt.Fprintln(out, `import "crypto/sha256"`)
+	fmt.Fprintln(out, `import "encoding/hex"`)
+	fmt.Fprintln(out, `import "bytes"`)
+	fmt.Fprintln(out, `import "net/url"`)
+	fmt.Fprintln(out, `import "encoding/xml"`)
+	fmt.Fprintln(out, `import "io"`)
+	fmt.Fprintln(out, `import "mime/multipart"`)
+	fmt.Fprintln(out, `import "errors"`)
 	codeTmpl.Execute(out, funcDecl)
 	validTmpl.Execute(out, structDecl)
+	rateTmpl.Execute(out, nil)
+	metricsTmpl.Execute(out, nil)
+	accessLogTmpl.Execute(out, nil)
+	cacheTmpl.Execute(out, nil)
+	idempotencyTmpl.Execute(out, nil)
+	corsTmpl.Execute(out, nil)
+	versionTmpl.Execute(out, nil)
+	batchTmpl.Execute(out, nil)
+	streamTmpl.Execute(out, nil)
+	uploadTmpl.Execute(out, nil)
+	bodyTmpl.Execute(out, nil)
+	messagesTmpl.Execute(out, nil)
+	negotiateTmpl.Execute(out, nil)
+	rest := restPoints(funcDecl)
+	jsonrpcTmpl.Execute(out, RPCData{Receivers: sortedKeys(funcDecl), Points: rest, MaxBody: rpcMaxBody(rest)})
+	routerTmpl.Execute(out, mounts)
+	metaTmpl.Execute(out, meta)
+	writeSource(outputFile, out.Bytes())
+}
+
+// writeSource gofmts generated code and writes it to file
+func writeSource(name string, src []byte) {
+	formatted, err := format.Source(src)
+	if err != nil {
+		log.Fatalf("Generated code for %s is broken: %v", name, err)
+	}
+	if err := os.WriteFile(name, formatted, 0644); err != nil {
+		log.Fatalf("Can not write %s: %v", name, err)
+	}
 }
 
 func getParamType(p *ast.Field) string {
 	return p.Type.(*ast.Ident).Name
 }
+
+func getResultType(p *ast.Field) string {
+	if star, ok := p.Type.(*ast.StarExpr); ok {
+		return star.X.(*ast.Ident).Name
+	}
+	return p.Type.(*ast.Ident).Name
+}
+
+func exprString(e ast.Expr) string {
+	buf := &bytes.Buffer{}
+	printer.Fprint(buf, token.NewFileSet(), e)
+	return buf.String()
+}
+
+func findTypeSpecs(node *ast.File) map[string]*ast.TypeSpec {
+	res := make(map[string]*ast.TypeSpec)
+	for _, el := range node.Decls {
+		if d, ok := el.(*ast.GenDecl); ok {
+			for _, spec := range d.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok {
+					res[ts.Name.Name] = ts
+				}
+			}
+		}
+	}
+	return res
+}
+
+// paramName returns the name under which a field is read from the request
+func paramName(f StructField) string {
+	if f.CustomName != "" {
+		return strings.ToLower(f.CustomName)
+	}
+	return strings.ToLower(f.Name)
+}
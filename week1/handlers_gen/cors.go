@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// CorsApi is the CORS policy of an endpoint in its annotation
+type CorsApi struct {
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods,omitempty"`
+	Headers       []string `json:"headers,omitempty"`
+	ExposeHeaders []string `json:"expose_headers,omitempty"`
+	Credentials   bool     `json:"credentials,omitempty"`
+	MaxAge        string   `json:"max_age,omitempty"`
+	MaxAgeSeconds int      `json:"-"`
+}
+
+var (
+	corsTmpl = template.Must(template.New("corsTmpl").Parse(`
+// CORSPolicy tells browsers on which origins may call endpoints
+type CORSPolicy struct {
+	// AllowOrigins are allowed origins like https://app.example.com, * allows any
+	AllowOrigins []string
+	// AllowMethods default to the methods of the endpoint
+	AllowMethods     []string
+	AllowHeaders     []string
+	// ExposeHeaders are response headers scripts may read, nil exposes
+	// DefaultExposeHeaders
+	ExposeHeaders    []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight answer
+	MaxAge time.Duration
+}
+
+// DefaultExposeHeaders are the headers generated handlers answer with,
+// besides ones browsers expose anyway
+var DefaultExposeHeaders = []string{"X-Request-Id", "ETag", "Retry-After", "Deprecation", "Sunset", "Link", "Idempotent-Replayed"}
+
+func (p *CORSPolicy) allowOrigin(origin string) bool {
+	for _, o := range p.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, a := range p.AllowHeaders {
+			if strings.EqualFold(a, h) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serveCORS adds CORS headers of policy to the response, it answers OPTIONS
+// requests itself and reports that they are done. Endpoint accepts methods.
+func serveCORS(w http.ResponseWriter, r *http.Request, policy *CORSPolicy, methods []string) bool {
+	allowed := methods
+	if policy != nil && len(policy.AllowMethods) > 0 {
+		allowed = policy.AllowMethods
+	}
+	origin := r.Header.Get("Origin")
+	corsOK := false
+	if policy != nil && !policy.AllowCredentials && policy.allowOrigin("*") {
+		// the answer is the same with any origin or none, caches may share it
+		corsOK = true
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if policy != nil {
+		// caches must not give the answer to one origin to another
+		w.Header().Add("Vary", "Origin")
+		corsOK = origin != "" && policy.allowOrigin(origin)
+		if corsOK {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if policy.AllowCredentials {
+				// browsers do not send credentials to *
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+	}
+	if r.Method != http.MethodOptions {
+		expose := DefaultExposeHeaders
+		if policy != nil && policy.ExposeHeaders != nil {
+			expose = policy.ExposeHeaders
+		}
+		if corsOK && len(expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(expose, ", "))
+		}
+		return false
+	}
+
+	w.Header().Set("Allow", strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", "))
+	reqMethod := r.Header.Get("Access-Control-Request-Method")
+	if corsOK && reqMethod != "" {
+		methodOK := false
+		for _, m := range allowed {
+			if m == reqMethod {
+				methodOK = true
+				break
+			}
+		}
+		if methodOK && policy.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+			if len(policy.AllowHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowHeaders, ", "))
+			}
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge/time.Second)))
+			}
+		} else {
+			// the browser fails the preflight without allow headers
+			w.Header().Del("Access-Control-Allow-Origin")
+			w.Header().Del("Access-Control-Allow-Credentials")
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+`))
+)
+
+// setupCors checks the CORS policy of the endpoint
+func setupCors(api *JsonApi) error {
+	if api.Cors == nil {
+		return nil
+	}
+	if len(api.Cors.Origins) == 0 {
+		return fmt.Errorf("cors needs origins")
+	}
+	for _, o := range api.Cors.Origins {
+		if o == "*" && api.Cors.Credentials {
+			return fmt.Errorf("cors can not allow credentials to any origin")
+		}
+	}
+	if api.Cors.MaxAge != "" {
+		d, err := time.ParseDuration(api.Cors.MaxAge)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("cors max_age %q must be a duration of a second or more", api.Cors.MaxAge)
+		}
+		api.Cors.MaxAgeSeconds = int(d / time.Second)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"log"
+	"net/url"
+	"text/template"
+)
+
+// FuzzSeed is a corpus entry of a fuzz target: query and body of a form,
+// or fields and file content of a multipart upload
+type FuzzSeed struct {
+	A string
+	B string
+}
+
+type FuzzPoint struct {
+	Point ApiPoint
+	Seeds []FuzzSeed
+}
+
+// pngHeader sniffs as image/png, seeding uploads with a file of an allowed type
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+var (
+	fuzzTmpl = template.Must(template.New("fuzzTmpl").Funcs(template.FuncMap{
+		"clientMethod": clientMethod,
+	}).Parse(`package {{ .Package }}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fuzzApigenHandler sends query and body as a form
+func fuzzApigenHandler(t *testing.T, h http.Handler, method, path, query, body string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.URL.RawQuery = query
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	fuzzApigenCheck(t, h, req, fmt.Sprintf("query %q body %q", query, body))
+}
+
+// fuzzApigenUpload sends fields, a query-encoded form, and file as every one
+// of files in a multipart/form-data body
+func fuzzApigenUpload(t *testing.T, h http.Handler, path, fields string, file []byte, files ...string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	values, _ := url.ParseQuery(fields)
+	for k, vv := range values {
+		for _, v := range vv {
+			mw.WriteField(k, v)
+		}
+	}
+	for _, name := range files {
+		part, _ := mw.CreateFormFile(name, name)
+		part.Write(file)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	fuzzApigenCheck(t, h, req, fmt.Sprintf("fields %q file %q", fields, file))
+}
+
+// fuzzApigenCheck checks that whatever params come in the handler answers
+// with a json envelope, or a stream of items and errors, and never treats
+// bad params as an internal error
+func fuzzApigenCheck(t *testing.T, h http.Handler, req *http.Request, desc string) {
+	req.Header.Set("X-Auth", "100500")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code == http.StatusInternalServerError {
+		t.Fatalf("internal error for %s: %s", desc, w.Body.String())
+	}
+	switch w.Header().Get("Content-Type") {
+	case "text/event-stream":
+		for _, event := range strings.Split(w.Body.String(), "\n\n") {
+			if event != "" && !strings.HasPrefix(event, "data: ") && !strings.HasPrefix(event, "event: error\ndata: ") {
+				t.Fatalf("bad event for %s: %q", desc, event)
+			}
+		}
+		return
+	case "application/x-ndjson":
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if line != "" && !json.Valid([]byte(line)) {
+				t.Fatalf("bad line for %s: %q", desc, line)
+			}
+		}
+		return
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cant unpack json for %s: %v", desc, err)
+	}
+	if _, ok := res["error"]; !ok {
+		t.Fatalf("no error key for %s: %s", desc, w.Body.String())
+	}
+}
+
+{{- range $ix, $fp := .Points }}
+{{- $point := $fp.Point }}
+
+func FuzzHandler{{ $point.Receiver }}{{ $point.Method }}(f *testing.F) {
+	{{- range $fp.Seeds }}
+	{{- if $point.HasFiles }}
+	f.Add({{ printf "%q" .A }}, []byte({{ printf "%q" .B }}))
+	{{- else }}
+	f.Add({{ printf "%q" .A }}, {{ printf "%q" .B }})
+	{{- end }}
+	{{- end }}
+	mock := &{{ $point.Receiver }}Mock{
+		{{- if $point.Callback }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			var item {{ $point.ItemType }}
+			return send(item)
+		},
+		{{- else if $point.Json.Stream }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			var item {{ $point.ItemType }}
+			items := make(chan {{ $point.ItemType }}, 1)
+			items <- item
+			close(items)
+			return items, nil
+		},
+		{{- else }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			return &{{ $point.OutParam }}{}, nil
+		},
+		{{- end }}
+	}
+	{{- if $point.HasFiles }}
+	f.Fuzz(func(t *testing.T, fields string, file []byte) {
+	{{- else }}
+	f.Fuzz(func(t *testing.T, query, body string) {
+	{{- end }}
+		h := New{{ $point.Receiver }}Handler(mock)
+		{{- range $point.Json.Middleware }}
+		h.RegisterMiddleware("{{ . }}", func(next http.Handler) http.Handler { return next })
+		{{- end }}
+		{{- if $point.HasFiles }}
+		fuzzApigenUpload(t, h, "{{ $point.Json.Url }}", fields, file
+			{{- range $point.InParamFields }}{{ if .IsFile }}, "{{ .ParamName }}"{{ end }}{{ end }})
+		{{- else }}
+		fuzzApigenHandler(t, h, "{{ $point | clientMethod }}", "{{ $point.Json.Url }}", query, body)
+		{{- end }}
+	})
+}
+{{- end }}
+`))
+)
+
+func genFuzz(name string, node *ast.File, funcDecl map[string][]ApiPoint) {
+	points := make([]FuzzPoint, 0)
+	for _, receiver := range sortedKeys(funcDecl) {
+		for _, p := range funcDecl[receiver] {
+			points = append(points, FuzzPoint{Point: p, Seeds: fuzzSeeds(p)})
+		}
+	}
+	out := &bytes.Buffer{}
+	err := fuzzTmpl.Execute(out, map[string]interface{}{
+		"Package": node.Name.Name,
+		"Points":  points,
+	})
+	if err != nil {
+		log.Fatalf("Can not generate fuzz targets: %v", err)
+	}
+	writeSource(name, out.Bytes())
+}
+
+// fuzzSeeds makes the corpus of an endpoint from queries of its test cases,
+// sent in the query and in the body of a form, or along with a valid and
+// an empty file for uploads. Seeds are unique.
+func fuzzSeeds(p ApiPoint) []FuzzSeed {
+	seen := make(map[FuzzSeed]bool)
+	res := make([]FuzzSeed, 0)
+	add := func(s FuzzSeed) {
+		if !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	for _, c := range testCases(p) {
+		if p.HasFiles() {
+			fields := withoutFiles(p, c.Query)
+			add(FuzzSeed{fields, pngHeader})
+			add(FuzzSeed{fields, ""})
+			continue
+		}
+		add(FuzzSeed{c.Query, ""})
+		add(FuzzSeed{"", c.Query})
+	}
+	return res
+}
+
+// withoutFiles drops file params from a query, files go in parts of their own
+func withoutFiles(p ApiPoint, query string) string {
+	values, _ := url.ParseQuery(query)
+	for _, f := range p.InParamFields {
+		if f.IsFile() {
+			values.Del(f.ParamName())
+		}
+	}
+	return values.Encode()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+)
+
+var (
+	idempotencyTmpl = template.Must(template.New("idempotencyTmpl").Parse(`
+// IdempotentResponse is the first response to a request with an Idempotency-Key
+type IdempotentResponse struct {
+	// Fingerprint identifies params of the request and formats it accepts,
+	// a repeat must have the same
+	Fingerprint string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore keeps responses of idempotent endpoints, implementations
+// must be safe for concurrent use and forget responses after ttl
+type IdempotencyStore interface {
+	Get(key string) (*IdempotentResponse, bool)
+	Put(key string, resp *IdempotentResponse, ttl time.Duration)
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore keeping at most
+// MaxItems responses, the oldest ones are forgotten first. 0 is no limit.
+type MemoryIdempotencyStore struct {
+	MaxItems int
+	mu       sync.Mutex
+	items    map[string]memoryIdempotencyItem
+	// order are keys by the time they are put, a key put again is in it twice
+	order []memoryIdempotencyKey
+}
+
+type memoryIdempotencyItem struct {
+	resp    *IdempotentResponse
+	expires time.Time
+}
+
+type memoryIdempotencyKey struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{MaxItems: 10000, items: make(map[string]memoryIdempotencyItem)}
+}
+
+func (s *MemoryIdempotencyStore) Get(key string) (*IdempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(item.expires) {
+		delete(s.items, key)
+		return nil, false
+	}
+	return item.resp, true
+}
+
+func (s *MemoryIdempotencyStore) Put(key string, resp *IdempotentResponse, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	_, replaced := s.items[key]
+	full := func() bool {
+		return s.MaxItems > 0 && !replaced && len(s.items) >= s.MaxItems
+	}
+	// with the same ttl the oldest responses expire first
+	for len(s.order) > 0 && (now.After(s.order[0].expires) || full()) {
+		oldest := s.order[0]
+		s.order = s.order[1:]
+		if item, ok := s.items[oldest.key]; ok && item.expires.Equal(oldest.expires) {
+			delete(s.items, oldest.key)
+		}
+	}
+	expires := now.Add(ttl)
+	s.items[key] = memoryIdempotencyItem{resp: resp, expires: expires}
+	s.order = append(s.order, memoryIdempotencyKey{key: key, expires: expires})
+}
+
+// apigenIdempotency serializes requests with the same Idempotency-Key
+type apigenIdempotency struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func newApigenIdempotency() *apigenIdempotency {
+	return &apigenIdempotency{inFlight: make(map[string]bool)}
+}
+
+// idempotentWriter records the response to store it once the handler is done
+type idempotentWriter struct {
+	http.ResponseWriter
+	idem        *apigenIdempotency
+	store       IdempotencyStore
+	ttl         time.Duration
+	key         string
+	fingerprint string
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *idempotentWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotentWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// finish stores the response, internal errors are not stored so that
+// the request can be retried
+func (w *idempotentWriter) finish() {
+	if w.status != 0 && w.status < 500 {
+		w.store.Put(w.key, &IdempotentResponse{
+			Fingerprint: w.fingerprint,
+			Status:      w.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		}, w.ttl)
+	}
+	w.idem.mu.Lock()
+	delete(w.idem.inFlight, w.key)
+	w.idem.mu.Unlock()
+}
+
+// begin handles the Idempotency-Key of a request to endpoint. It either answers
+// the request itself, replaying the stored response or rejecting the key, or
+// returns the writer to serve the request with.
+func (idem *apigenIdempotency) begin(w http.ResponseWriter, r *http.Request, store IdempotencyStore, ttl time.Duration, endpoint, key string) (*idempotentWriter, bool) {
+	if len(key) > 255 {
+		writeError(w, r, http.StatusBadRequest, "idempotency_key_too_long", "idempotency key is too long")
+		return nil, true
+	}
+	r.ParseForm()
+	// the stored body is replayed as is, so a repeat must get it in the same format
+	errFormat, _ := negotiate(r.Header.Get("Accept"), false)
+	format, _ := negotiate(r.Header.Get("Accept"), true)
+	sum := sha256.Sum256([]byte(r.Method + "\n" + errFormat + "\n" + format + "\n" + r.Form.Encode()))
+	fingerprint := hex.EncodeToString(sum[:])
+	// keys of different clients must not clash
+	auth := sha256.Sum256([]byte(r.Header.Get("X-Auth")))
+	key = endpoint + "\n" + hex.EncodeToString(auth[:8]) + "\n" + key
+
+	idem.mu.Lock()
+	if idem.inFlight[key] {
+		idem.mu.Unlock()
+		writeError(w, r, http.StatusConflict, "idempotency_in_progress", "request with this idempotency key is in progress")
+		return nil, true
+	}
+	if stored, ok := store.Get(key); ok {
+		idem.mu.Unlock()
+		if stored.Fingerprint != fingerprint {
+			writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", "idempotency key is reused with different params")
+			return nil, true
+		}
+		setResult(r, "replayed")
+		w.Header().Set("Content-Type", stored.ContentType)
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return nil, true
+	}
+	idem.inFlight[key] = true
+	idem.mu.Unlock()
+	return &idempotentWriter{
+		ResponseWriter: w,
+		idem:           idem,
+		store:          store,
+		ttl:            ttl,
+		key:            key,
+		fingerprint:    fingerprint,
+	}, false
+}
+`))
+)
+
+// setupIdempotent checks that only POST endpoints are idempotent by key,
+// GET ones are idempotent anyway
+func setupIdempotent(api *JsonApi) error {
+	if api.Idempotent && api.Method != "POST" {
+		return fmt.Errorf("only POST endpoints can be idempotent")
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"text/template"
+)
+
+// RPCData is what jsonrpcTmpl generates the JSON-RPC handler of
+type RPCData struct {
+	Receivers []string
+	Points    map[string][]ApiPoint
+	// MaxBody is the largest max_body of the methods
+	MaxBody int64
+}
+
+// rpcMaxBody is the largest body limit of the points
+func rpcMaxBody(funcDecl map[string][]ApiPoint) int64 {
+	res := int64(0)
+	for _, points := range funcDecl {
+		for _, p := range points {
+			if p.Json.MaxBodyBytes > res {
+				res = p.Json.MaxBodyBytes
+			}
+		}
+	}
+	return res
+}
+
+var (
+	jsonrpcTmpl = template.Must(template.New("jsonrpcTmpl").Funcs(template.FuncMap{
+		"lowerFirst": lowerFirst,
+	}).Parse(`
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+)
+
+type jsonrpcRequest struct {
+	Jsonrpc string          ` + "`json:\"jsonrpc\"`" + `
+	Method  string          ` + "`json:\"method\"`" + `
+	Params  json.RawMessage ` + "`json:\"params\"`" + `
+	ID      json.RawMessage ` + "`json:\"id\"`" + `
+}
+
+type jsonrpcError struct {
+	Code    int         ` + "`json:\"code\"`" + `
+	Message string      ` + "`json:\"message\"`" + `
+	Data    interface{} ` + "`json:\"data,omitempty\"`" + `
+}
+
+type jsonrpcResponse struct {
+	Jsonrpc string          ` + "`json:\"jsonrpc\"`" + `
+	Result  interface{}     ` + "`json:\"result,omitempty\"`" + `
+	Error   *jsonrpcError   ` + "`json:\"error,omitempty\"`" + `
+	ID      json.RawMessage ` + "`json:\"id\"`" + `
+}
+
+type jsonrpcMethod func(r *http.Request, params json.RawMessage) (interface{}, error)
+
+// JSONRPCHandler serves endpoints of all receivers as JSON-RPC 2.0 methods
+// named like MyApi.Create. Params are an object keyed by param names, they are
+// validated like the ones of http endpoints. Auth and rate limits apply,
+// http methods, middlewares and caching do not.
+type JSONRPCHandler struct {
+	// MaxBatch is the most requests a batch may have
+	MaxBatch int
+	// MaxBody is the most bytes a request body may have, 0 is no limit.
+	// It defaults to the largest max_body of the methods, params of a call
+	// are also limited by max_body of its method.
+	MaxBody int64
+	methods map[string]jsonrpcMethod
+}
+
+func NewJSONRPCHandler({{ range $ix, $r := .Receivers }}{{ if $ix }}, {{ end }}{{ $r | lowerFirst }} *{{ $r }}Handler{{ end }}) *JSONRPCHandler {
+	return &JSONRPCHandler{
+		MaxBatch: 100,
+		MaxBody:  {{ .MaxBody }},
+		methods: map[string]jsonrpcMethod{
+			{{- range $ix, $r := .Receivers }}
+			{{- range $ix, $point := index $.Points $r }}
+			"{{ $r }}.{{ $point.Method }}": {{ $r | lowerFirst }}.rpc{{ $point.Method }},
+			{{- end }}
+			{{- end }}
+		},
+	}
+}
+
+func (h *JSONRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.write(w, http.StatusMethodNotAllowed, jsonrpcFail(nil, jsonrpcInvalidRequest, "only POST is allowed", nil))
+		return
+	}
+	if h.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBody)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			msg := fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit)
+			h.write(w, http.StatusRequestEntityTooLarge, jsonrpcFail(nil, jsonrpcInvalidRequest, msg, nil))
+			return
+		}
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcParseError, "parse error", nil))
+		return
+	}
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		res := h.call(r, raw)
+		if res == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.write(w, http.StatusOK, res)
+		return
+	}
+
+	batch := []json.RawMessage{}
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcParseError, "parse error", nil))
+		return
+	}
+	if len(batch) == 0 {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcInvalidRequest, "empty batch", nil))
+		return
+	}
+	if h.MaxBatch > 0 && len(batch) > h.MaxBatch {
+		h.write(w, http.StatusOK, jsonrpcFail(nil, jsonrpcInvalidRequest, fmt.Sprintf("batch must have at most %d requests", h.MaxBatch), nil))
+		return
+	}
+	results := make([]*jsonrpcResponse, len(batch))
+	wg := &sync.WaitGroup{}
+	for ix, req := range batch {
+		wg.Add(1)
+		go func(ix int, req json.RawMessage) {
+			defer wg.Done()
+			results[ix] = h.call(r, req)
+		}(ix, req)
+	}
+	wg.Wait()
+	res := make([]*jsonrpcResponse, 0, len(results))
+	for _, el := range results {
+		// notifications get no response
+		if el != nil {
+			res = append(res, el)
+		}
+	}
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.write(w, http.StatusOK, res)
+}
+
+func (h *JSONRPCHandler) write(w http.ResponseWriter, status int, res interface{}) {
+	body, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// call runs a single request, it returns nil for notifications
+func (h *JSONRPCHandler) call(r *http.Request, raw json.RawMessage) (res *jsonrpcResponse) {
+	req := jsonrpcRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil || req.Jsonrpc != "2.0" || req.Method == "" {
+		return jsonrpcFail(nil, jsonrpcInvalidRequest, "invalid request", nil)
+	}
+	notification := len(req.ID) == 0
+	defer func() {
+		if notification {
+			res = nil
+		}
+	}()
+	method, ok := h.methods[req.Method]
+	if !ok {
+		return jsonrpcFail(req.ID, jsonrpcMethodNotFound, "method not found", nil)
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("%s panic: %v\n%s", req.Method, rec, debug.Stack())
+			res = jsonrpcFail(req.ID, jsonrpcInternalError, "internal error", nil)
+		}
+	}()
+	answer, err := method(r, req.Params)
+	if err != nil {
+		return jsonrpcFailWith(req.ID, err, messageLanguage(r.Header.Get("Accept-Language")))
+	}
+	return &jsonrpcResponse{Jsonrpc: "2.0", Result: answer, ID: req.ID}
+}
+
+func jsonrpcFail(id json.RawMessage, code int, msg string, data interface{}) *jsonrpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		Jsonrpc: "2.0",
+		Error:   &jsonrpcError{Code: code, Message: msg, Data: data},
+		ID:      id,
+	}
+}
+
+// jsonrpcFailWith maps the http status of an error to a JSON-RPC code,
+// the status itself, the code and details of the error go to data
+func jsonrpcFailWith(id json.RawMessage, err error, lang string) *jsonrpcResponse {
+	info := errorInfoOf(err, lang)
+	data := map[string]interface{}{"status": info.Status}
+	if info.Code != "" {
+		data["code"] = info.Code
+	}
+	for k, v := range info.Details {
+		data[k] = v
+	}
+	apiErr, ok := err.(ApiError)
+	if e, isPtr := err.(*ApiError); isPtr {
+		apiErr, ok = *e, true
+	}
+	if vErr, isValidation := apiErr.Err.(*ValidationError); ok && isValidation {
+		data["rule"] = vErr.Rule
+	}
+	code := jsonrpcServerError
+	switch {
+	case info.Status == http.StatusBadRequest:
+		code = jsonrpcInvalidParams
+	case info.Status >= 500:
+		code = jsonrpcInternalError
+	}
+	return jsonrpcFail(id, code, info.Message, data)
+}
+
+{{- range $ix, $r := .Receivers }}
+{{- range $ix, $point := index $.Points $r }}
+
+func (h *{{ $r }}Handler) rpc{{ $point.Method }}(r *http.Request, params json.RawMessage) (interface{}, error) {
+	{{- if and $point.Json.Rate (eq $point.Json.Key "ip") }}
+	if ok, _ := h.limiter{{ $point.Method }}.allow(rateKeyIP(r)); !ok {
+		return nil, ApiError{HTTPStatus: http.StatusTooManyRequests, Err: fmt.Errorf("too many requests"), Code: "rate_limited"}
+	}
+	{{- end }}
+	{{- if $point.Json.Auth }}
+	if r.Header.Get("X-Auth") != "100500" {
+		return nil, ApiError{HTTPStatus: http.StatusForbidden, Err: fmt.Errorf("unauthorized"), Code: "unauthorized"}
+	}
+	{{- end }}
+	{{- if and $point.Json.Rate (eq $point.Json.Key "auth") }}
+	// the token is checked, fake ones do not get buckets
+	if ok, _ := h.limiter{{ $point.Method }}.allow(rateKeyAuth(r)); !ok {
+		return nil, ApiError{HTTPStatus: http.StatusTooManyRequests, Err: fmt.Errorf("too many requests"), Code: "rate_limited"}
+	}
+	{{- end }}
+	{{- if $point.Json.MaxBodyBytes }}
+	if len(params) > {{ $point.Json.MaxBodyBytes }} {
+		return nil, ApiError{
+			HTTPStatus: http.StatusRequestEntityTooLarge,
+			Err:        fmt.Errorf("request body must be at most %d bytes", {{ $point.Json.MaxBodyBytes }}),
+			Code:       "body_too_large",
+		}
+	}
+	{{- end }}
+	raw := map[string]json.RawMessage{}
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("params must be an object"), Code: "bad_params"}
+		}
+	}
+	{{- if $point.Json.Strict }}
+	for k := range raw {
+		switch k {
+		{{- if $point.InParamFields }}
+		case {{ $point.KnownParams }}:
+		{{- end }}
+		default:
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError(k, "unknown", "unknown", k),
+			}
+		}
+	}
+	{{- end }}
+	in := {{ $point.InParam }}{}
+	{{- range $ix, $f := $point.InParamFields }}
+	if v, ok := raw["{{ $f.ParamName }}"]; ok {
+		if err := json.Unmarshal(v, &in.{{ $f.Name }}); err != nil {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        newValidationError("{{ $f.ParamName }}", "type", "type", "{{ $f.ParamName }}", "{{ $f.Type }}"),
+			}
+		}
+	}
+	{{- end }}
+	if err := Validate{{ $point.InParam }}(&in); err != nil {
+		return nil, err
+	}
+	return h.Service.{{ $point.Method }}(r.Context(), in)
+}
+{{- end }}
+{{- end }}
+`))
+)
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"text/template"
+)
+
+var (
+	messagesTmpl = template.Must(template.New("messagesTmpl").Parse(`
+// ValidationMessages are formats of validation messages by language and key,
+// the args of a ValidationError go into them. en is the default language,
+// a key missing in another language falls back to it.
+var ValidationMessages = map[string]map[string]string{
+	"en": {
+		"required": "%s must me not empty",
+		"min":      "%s must be >= %d",
+		"min_len":  "%s len must be >= %d",
+		"max":      "%s must be <= %d",
+		"max_len":  "%s len must be <= %d",
+		"enum":     "%s must be one of [%v]",
+		"type":     "%s must be %s",
+		"maxsize":  "%s size must be <= %d bytes",
+		"mimetype": "%s must be one of [%v]",
+		"unknown":  "unknown param %s",
+	},
+	"ru": {
+		"required": "параметр %s не должен быть пустым",
+		"min":      "параметр %s должен быть >= %d",
+		"min_len":  "длина параметра %s должна быть >= %d",
+		"max":      "параметр %s должен быть <= %d",
+		"max_len":  "длина параметра %s должна быть <= %d",
+		"enum":     "параметр %s должен быть одним из [%v]",
+		"type":     "параметр %s должен быть типа %s",
+		"maxsize":  "размер файла %s должен быть <= %d байт",
+		"mimetype": "файл %s должен быть одного из типов [%v]",
+		"unknown":  "неизвестный параметр %s",
+	},
+}
+
+func newValidationError(field, rule, key string, args ...interface{}) *ValidationError {
+	e := &ValidationError{Field: field, Rule: rule, Key: key, Args: args}
+	e.Message = e.Localize("en")
+	return e
+}
+
+// Localize makes the message of the error in lang
+func (e *ValidationError) Localize(lang string) string {
+	format, ok := ValidationMessages[lang][e.Key]
+	if !ok {
+		format, ok = ValidationMessages["en"][e.Key]
+	}
+	if !ok {
+		return e.Message
+	}
+	return fmt.Sprintf(format, e.Args...)
+}
+
+// messageLanguage picks the language of messages by Accept-Language, en if none fits
+func messageLanguage(acceptLanguage string) string {
+	best, bestQ := "en", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// ru-RU is ru
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if ix := strings.Index(lang, "-"); ix >= 0 {
+			lang = lang[:ix]
+		}
+		if _, ok := ValidationMessages[lang]; ok && q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+`))
+)
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"text/template"
+)
+
+var (
+	metricsTmpl = template.Must(template.New("metricsTmpl").Parse(`
+// apigenCall tracks a call of an endpoint for metrics and access log
+type apigenCall struct {
+	http.ResponseWriter
+	metrics   *apigenMetrics
+	logger    *log.Logger
+	endpoint  string
+	method    string
+	requestID string
+	principal string
+	status    int
+	result    string
+	field     string
+	rule      string
+	start     time.Time
+}
+
+type apigenCallKey struct{}
+
+// Unwrap lets http.ResponseController flush streams through the call
+func (c *apigenCall) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *apigenCall) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *apigenCall) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *apigenCall) end() {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.result == "" {
+		c.result = "ok"
+		if c.status >= 400 {
+			c.result = "rejected"
+		}
+	}
+	c.metrics.end(c)
+	if c.logger != nil {
+		c.writeLog()
+	}
+}
+
+// setResult tells metrics how the call of the endpoint ended up:
+// ok, rejected, invalid (params), error (of the method) or panic
+func setResult(r *http.Request, result string) {
+	if c, ok := r.Context().Value(apigenCallKey{}).(*apigenCall); ok {
+		c.result = result
+	}
+}
+
+var apigenLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type apigenRequestsKey struct {
+	endpoint string
+	status   int
+	result   string
+}
+
+type apigenHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// apigenMetrics are metrics of endpoints of a receiver
+type apigenMetrics struct {
+	receiver string
+	mu       sync.Mutex
+	requests map[apigenRequestsKey]uint64
+	latency    map[string]*apigenHistogram
+	inFlight   map[string]int64
+	deprecated map[string]uint64
+}
+
+func newApigenMetrics(receiver string) *apigenMetrics {
+	return &apigenMetrics{
+		receiver: receiver,
+		requests: make(map[apigenRequestsKey]uint64),
+		latency:    make(map[string]*apigenHistogram),
+		inFlight:   make(map[string]int64),
+		deprecated: make(map[string]uint64),
+	}
+}
+
+func (m *apigenMetrics) begin(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[endpoint]++
+}
+
+// deprecatedCall counts a call of a deprecated endpoint
+func (m *apigenMetrics) deprecatedCall(endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deprecated[endpoint]++
+}
+
+func (m *apigenMetrics) end(c *apigenCall) {
+	elapsed := time.Since(c.start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[c.endpoint]--
+	m.requests[apigenRequestsKey{c.endpoint, c.status, c.result}]++
+	hist, ok := m.latency[c.endpoint]
+	if !ok {
+		hist = &apigenHistogram{buckets: make([]uint64, len(apigenLatencyBuckets))}
+		m.latency[c.endpoint] = hist
+	}
+	for ix, le := range apigenLatencyBuckets {
+		if elapsed <= le {
+			hist.buckets[ix]++
+		}
+	}
+	hist.sum += elapsed
+	hist.count++
+}
+
+var apigenLabelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// ServeHTTP writes the metrics in prometheus text exposition format
+func (m *apigenMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rcv := apigenLabelEscaper.Replace(m.receiver)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]apigenRequestsKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		if keys[i].status != keys[j].status {
+			return keys[i].status < keys[j].status
+		}
+		return keys[i].result < keys[j].result
+	})
+	fmt.Fprintln(w, "# HELP apigen_requests_total Requests by endpoint, status and result.")
+	fmt.Fprintln(w, "# TYPE apigen_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "apigen_requests_total{receiver=\"%s\",endpoint=\"%s\",status=\"%d\",result=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(k.endpoint), k.status, k.result, m.requests[k])
+	}
+
+	endpoints := make([]string, 0, len(m.latency))
+	for e := range m.latency {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_request_duration_seconds Latency of requests by endpoint.")
+	fmt.Fprintln(w, "# TYPE apigen_request_duration_seconds histogram")
+	for _, e := range endpoints {
+		hist := m.latency[e]
+		ep := apigenLabelEscaper.Replace(e)
+		for ix, le := range apigenLatencyBuckets {
+			fmt.Fprintf(w, "apigen_request_duration_seconds_bucket{receiver=\"%s\",endpoint=\"%s\",le=\"%s\"} %d\n",
+				rcv, ep, strconv.FormatFloat(le, 'g', -1, 64), hist.buckets[ix])
+		}
+		fmt.Fprintf(w, "apigen_request_duration_seconds_bucket{receiver=\"%s\",endpoint=\"%s\",le=\"+Inf\"} %d\n", rcv, ep, hist.count)
+		fmt.Fprintf(w, "apigen_request_duration_seconds_sum{receiver=\"%s\",endpoint=\"%s\"} %s\n",
+			rcv, ep, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "apigen_request_duration_seconds_count{receiver=\"%s\",endpoint=\"%s\"} %d\n", rcv, ep, hist.count)
+	}
+
+	endpoints = endpoints[:0]
+	for e := range m.inFlight {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_requests_in_flight Requests being served by endpoint.")
+	fmt.Fprintln(w, "# TYPE apigen_requests_in_flight gauge")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "apigen_requests_in_flight{receiver=\"%s\",endpoint=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(e), m.inFlight[e])
+	}
+
+	endpoints = endpoints[:0]
+	for e := range m.deprecated {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintln(w, "# HELP apigen_deprecated_requests_total Requests to deprecated endpoints.")
+	fmt.Fprintln(w, "# TYPE apigen_deprecated_requests_total counter")
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "apigen_deprecated_requests_total{receiver=\"%s\",endpoint=\"%s\"} %d\n",
+			rcv, apigenLabelEscaper.Replace(e), m.deprecated[e])
+	}
+}
+`))
+)
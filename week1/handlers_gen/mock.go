@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"log"
+	"text/template"
+)
+
+var (
+	mockTmpl = template.Must(template.New("mockTmpl").Parse(`package {{ .Package }}
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+{{- range $receiver, $points := .Receivers }}
+
+// {{ $receiver }}Mock is a {{ $receiver }}Service with stubbed methods which records its calls
+type {{ $receiver }}Mock struct {
+	mu sync.Mutex
+{{- range $ix, $point := $points }}
+	{{ $point.Method }}Func func{{ $point.Signature }}
+{{- end }}
+{{- range $ix, $point := $points }}
+	calls{{ $point.Method }} []{{ $point.InParam }}
+{{- end }}
+}
+
+var _ {{ $receiver }}Service = &{{ $receiver }}Mock{}
+
+{{- range $ix, $point := $points }}
+
+func (m *{{ $receiver }}Mock) {{ $point.Method }}{{ $point.Signature }} {
+	m.mu.Lock()
+	m.calls{{ $point.Method }} = append(m.calls{{ $point.Method }}, in)
+	m.mu.Unlock()
+	{{- if $point.Callback }}
+	if m.{{ $point.Method }}Func == nil {
+		return fmt.Errorf("{{ $receiver }}Mock.{{ $point.Method }} is not stubbed")
+	}
+	return m.{{ $point.Method }}Func(ctx, in, send)
+	{{- else }}
+	if m.{{ $point.Method }}Func == nil {
+		var res {{ $point.OutType }}
+		return res, fmt.Errorf("{{ $receiver }}Mock.{{ $point.Method }} is not stubbed")
+	}
+	return m.{{ $point.Method }}Func(ctx, in)
+	{{- end }}
+}
+
+// {{ $point.Method }}Calls returns params of all {{ $point.Method }} calls
+func (m *{{ $receiver }}Mock) {{ $point.Method }}Calls() []{{ $point.InParam }} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]{{ $point.InParam }}, len(m.calls{{ $point.Method }}))
+	copy(res, m.calls{{ $point.Method }})
+	return res
+}
+{{- end }}
+{{- end }}
+`))
+)
+
+func genMock(name string, node *ast.File, funcDecl map[string][]ApiPoint) {
+	out := &bytes.Buffer{}
+	err := mockTmpl.Execute(out, map[string]interface{}{
+		"Package":   node.Name.Name,
+		"Receivers": funcDecl,
+	})
+	if err != nil {
+		log.Fatalf("Can not generate mocks: %v", err)
+	}
+	writeSource(name, out.Bytes())
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"text/template"
+)
+
+var (
+	negotiateTmpl = template.Must(template.New("negotiateTmpl").Parse(`
+// errorInfo is what an error response tells about the error
+type errorInfo struct {
+	Status  int
+	Message string
+	Code    string
+	Details map[string]interface{}
+}
+
+// errorInfoOf reads the status, code and details of an error. Validation errors
+// get validation.<rule> codes, the field in details and the message in lang,
+// errors other than ApiError are internal ones.
+func errorInfoOf(err error, lang string) errorInfo {
+	apiErr, ok := err.(ApiError)
+	if e, isPtr := err.(*ApiError); isPtr {
+		apiErr, ok = *e, true
+	}
+	if !ok {
+		return errorInfo{Status: http.StatusInternalServerError, Message: err.Error()}
+	}
+	info := errorInfo{Status: apiErr.HTTPStatus, Message: apiErr.Error(), Code: apiErr.Code}
+	if vErr, isValidation := apiErr.Err.(*ValidationError); isValidation {
+		if info.Code == "" {
+			info.Code = "validation." + vErr.Rule
+			info.Message = vErr.Localize(lang)
+		}
+		info.Details = map[string]interface{}{"field": vErr.Field}
+	}
+	for k, v := range apiErr.Details {
+		if info.Details == nil {
+			info.Details = make(map[string]interface{})
+		}
+		info.Details[k] = v
+	}
+	return info
+}
+
+// jsonError is the envelope of errors in json
+type jsonError struct {
+	Error   string                 ` + "`json:\"error\"`" + `
+	Code    string                 ` + "`json:\"code,omitempty\"`" + `
+	Details map[string]interface{} ` + "`json:\"details,omitempty\"`" + `
+}
+
+// xmlEnvelope is the envelope of responses in xml, the response keeps xml tags of its type
+type xmlEnvelope struct {
+	XMLName  xml.Name    ` + "`xml:\"envelope\"`" + `
+	Error    string      ` + "`xml:\"error\"`" + `
+	Code     string      ` + "`xml:\"code,omitempty\"`" + `
+	Details  *xmlDetails ` + "`xml:\"details,omitempty\"`" + `
+	Response interface{} ` + "`xml:\"response,omitempty\"`" + `
+}
+
+type xmlDetails struct {
+	Detail []xmlDetail ` + "`xml:\"detail\"`" + `
+}
+
+type xmlDetail struct {
+	Name  string ` + "`xml:\"name,attr\"`" + `
+	Value string ` + "`xml:\",chardata\"`" + `
+}
+
+// negotiate picks the format of a response by Accept: json, xml or text.
+// text is a format of errors only, it is not picked for a success.
+// ok is false if no format is acceptable.
+func negotiate(accept string, success bool) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "json", true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		format := ""
+		switch strings.ToLower(strings.TrimSpace(fields[0])) {
+		case "application/json", "application/*", "*/*":
+			format = "json"
+		case "application/xml", "text/xml":
+			format = "xml"
+		case "text/plain", "text/*":
+			if !success {
+				format = "text"
+			}
+		}
+		if format != "" && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, best != ""
+}
+
+// encodeEnvelope encodes the envelope of a response, of an error if e is not nil
+func encodeEnvelope(format string, e *errorInfo, response interface{}) ([]byte, string) {
+	switch format {
+	case "xml":
+		env := xmlEnvelope{}
+		if e == nil {
+			env.Response = response
+		} else {
+			env.Error, env.Code = e.Message, e.Code
+			keys := make([]string, 0, len(e.Details))
+			for k := range e.Details {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			if len(keys) > 0 {
+				env.Details = &xmlDetails{}
+			}
+			for _, k := range keys {
+				env.Details.Detail = append(env.Details.Detail, xmlDetail{Name: k, Value: fmt.Sprint(e.Details[k])})
+			}
+		}
+		body, err := xml.Marshal(env)
+		if err != nil {
+			body, _ = xml.Marshal(xmlEnvelope{Error: "can not encode response"})
+		}
+		return append([]byte(xml.Header), body...), "application/xml"
+	case "text":
+		if e != nil {
+			return []byte(e.Message + "\n"), "text/plain; charset=utf-8"
+		}
+	}
+	if e != nil {
+		body, _ := json.Marshal(jsonError{Error: e.Message, Code: e.Code, Details: e.Details})
+		return body, "application/json"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"error":    "",
+		"response": response,
+	})
+	return body, "application/json"
+}
+
+// encodeResponse encodes the successful response in the format the request accepts,
+// handlers answer 406 before calling the service if there is none
+func encodeResponse(r *http.Request, response interface{}) ([]byte, string) {
+	format, _ := negotiate(r.Header.Get("Accept"), true)
+	return encodeEnvelope(format, nil, response)
+}
+
+// writeError answers with an error and its stable code in the format the request
+// accepts, json if none
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, errMsg string) {
+	writeErrorInfo(w, r, errorInfo{Status: status, Message: errMsg, Code: code})
+}
+
+// writeApiError answers with err along with its code and details
+func writeApiError(w http.ResponseWriter, r *http.Request, err error) {
+	writeErrorInfo(w, r, errorInfoOf(err, messageLanguage(r.Header.Get("Accept-Language"))))
+}
+
+func writeErrorInfo(w http.ResponseWriter, r *http.Request, e errorInfo) {
+	format, _ := negotiate(r.Header.Get("Accept"), false)
+	body, contentType := encodeEnvelope(format, &e, nil)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
+`))
+)
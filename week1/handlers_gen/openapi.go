@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ApiMeta is the description of a receiver served at runtime by ServeHTTP
+type ApiMeta struct {
+	Receiver string
+	Routes   string
+	OpenAPI  string
+}
+
+type RouteDoc struct {
+	Url        string         `json:"url"`
+	Handler    string         `json:"handler"`
+	Methods    []string       `json:"methods"`
+	Auth       bool           `json:"auth"`
+	Middleware []string       `json:"middleware,omitempty"`
+	Rate       string         `json:"rate,omitempty"`
+	Burst      int            `json:"burst,omitempty"`
+	Key        string         `json:"key,omitempty"`
+	Cache      string         `json:"cache,omitempty"`
+	Idempotent bool           `json:"idempotent,omitempty"`
+	MaxBody    string         `json:"max_body,omitempty"`
+	Strict     bool           `json:"strict,omitempty"`
+	Stream     string         `json:"stream,omitempty"`
+	Cors       *CorsApi       `json:"cors,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	Deprecated *DeprecatedApi `json:"deprecated,omitempty"`
+	Params     []ParamDoc     `json:"params"`
+}
+
+type ParamDoc struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Min      *int     `json:"min,omitempty"`
+	Max      *int     `json:"max,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+	Default  string   `json:"default,omitempty"`
+}
+
+var (
+	metaTmpl = template.Must(template.New("metaTmpl").Parse(`
+{{- range $receiver, $meta := . }}
+
+const routes{{ $receiver }} = ` + "`{{ $meta.Routes }}`" + `
+
+const openapi{{ $receiver }} = ` + "`{{ $meta.OpenAPI }}`" + `
+{{- end }}
+`))
+)
+
+func buildMeta(funcDecl map[string][]ApiPoint, types map[string]*ast.TypeSpec) map[string]ApiMeta {
+	res := make(map[string]ApiMeta)
+	for receiver, points := range funcDecl {
+		routes := make([]RouteDoc, len(points))
+		for ix, p := range points {
+			routes[ix] = RouteDoc{
+				Url:        p.Json.Url,
+				Handler:    p.Method,
+				Methods:    pointMethods(p),
+				Auth:       p.Json.Auth,
+				Middleware: p.Json.Middleware,
+				Rate:       p.Json.Rate,
+				Burst:      p.Json.Burst,
+				Key:        p.Json.Key,
+				Cache:      p.Json.Cache,
+				Idempotent: p.Json.Idempotent,
+				MaxBody:    p.Json.MaxBody,
+				Strict:     p.Json.Strict,
+				Stream:     p.Json.Stream,
+				Cors:       p.Json.Cors,
+				Version:    p.Json.Version,
+				Deprecated: p.Json.Deprecated,
+				Params:     paramDocs(p.InParamFields),
+			}
+		}
+		routesDoc, _ := json.Marshal(map[string]interface{}{
+			"receiver": receiver,
+			"prefix":   points[0].Json.Prefix,
+			"batch":    points[0].Json.Batch,
+			"routes":   routes,
+		})
+		openapiDoc, _ := json.MarshalIndent(buildOpenAPI(receiver, points, types), "", "  ")
+		res[receiver] = ApiMeta{
+			Receiver: receiver,
+			Routes:   rawString(routesDoc),
+			OpenAPI:  rawString(openapiDoc),
+		}
+	}
+	return res
+}
+
+func genOpenAPIFiles(dir string, meta map[string]ApiMeta) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Can not create %s: %v", dir, err)
+	}
+	for receiver, m := range meta {
+		name := filepath.Join(dir, receiver+".json")
+		if err := os.WriteFile(name, []byte(m.OpenAPI+"\n"), 0644); err != nil {
+			log.Fatalf("Can not write %s: %v", name, err)
+		}
+	}
+}
+
+// rawString makes a json document safe to be placed into a go raw string literal
+func rawString(doc []byte) string {
+	return strings.Replace(string(doc), "`", `\u0060`, -1)
+}
+
+// pointMethods returns the http methods accepted by the endpoint
+func pointMethods(p ApiPoint) []string {
+	if p.Json.Method != "" {
+		return []string{p.Json.Method}
+	}
+	return []string{"GET", "POST"}
+}
+
+func paramDocs(fields []StructField) []ParamDoc {
+	res := make([]ParamDoc, len(fields))
+	for ix, f := range fields {
+		d := ParamDoc{
+			Name: paramName(f),
+			Type: f.Type,
+		}
+		for _, v := range f.Validators {
+			switch v.Name {
+			case "required":
+				d.Required = true
+			case "min":
+				n, _ := strconv.Atoi(v.Value)
+				d.Min = &n
+			case "max":
+				n, _ := strconv.Atoi(v.Value)
+				d.Max = &n
+			case "enum":
+				d.Enum = strings.Split(v.Value, "|")
+			case "default":
+				d.Default = v.Value
+			}
+		}
+		res[ix] = d
+	}
+	return res
+}
+
+func buildOpenAPI(receiver string, points []ApiPoint, types map[string]*ast.TypeSpec) map[string]interface{} {
+	paths := make(map[string]interface{})
+	schemas := make(map[string]interface{})
+	for _, p := range points {
+		addSchema(p.OutParam, types, schemas)
+		ops := make(map[string]interface{})
+		for _, m := range pointMethods(p) {
+			op := map[string]interface{}{
+				"operationId": p.Method,
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "success",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{
+									"type": "object",
+									"properties": map[string]interface{}{
+										"error":    map[string]interface{}{"type": "string"},
+										"response": map[string]interface{}{"$ref": "#/components/schemas/" + p.OutParam},
+									},
+								},
+							},
+						},
+					},
+					"default": map[string]interface{}{
+						"description": "error",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+							},
+						},
+					},
+				},
+			}
+			if p.Json.Stream != "" {
+				// every item is a line of ndjson or an event
+				contentType := "application/x-ndjson"
+				if p.Json.Stream == "sse" {
+					contentType = "text/event-stream"
+				}
+				op["responses"].(map[string]interface{})["200"] = map[string]interface{}{
+					"description": "stream of items",
+					"content": map[string]interface{}{
+						contentType: map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/" + p.OutParam},
+						},
+					},
+				}
+			}
+			if p.Json.Rate != "" {
+				op["responses"].(map[string]interface{})["429"] = map[string]interface{}{
+					"description": "rate limit of " + p.Json.Rate + " exceeded",
+					"headers": map[string]interface{}{
+						"Retry-After": map[string]interface{}{"schema": map[string]interface{}{"type": "integer"}},
+					},
+				}
+			}
+			if p.Json.MaxBody != "" {
+				op["responses"].(map[string]interface{})["413"] = map[string]interface{}{
+					"description": "request body is over " + p.Json.MaxBody,
+				}
+			}
+			if p.Json.Cache != "" && m == "GET" {
+				op["responses"].(map[string]interface{})["304"] = map[string]interface{}{
+					"description": "not modified since the ETag of If-None-Match",
+				}
+			}
+			if d := p.Json.Deprecated; d != nil {
+				op["deprecated"] = true
+				desc := "deprecated"
+				if d.Sunset != "" {
+					desc += ", goes away on " + d.Sunset
+				}
+				if d.Replacement != "" {
+					desc += ", use " + d.Replacement + " instead"
+				}
+				op["description"] = desc
+			}
+			if p.Json.Idempotent {
+				op["parameters"] = []interface{}{map[string]interface{}{
+					"name":        "Idempotency-Key",
+					"in":          "header",
+					"description": "repeats with the same key get the first response",
+					"schema":      map[string]interface{}{"type": "string", "maxLength": 255},
+				}}
+				op["responses"].(map[string]interface{})["422"] = map[string]interface{}{
+					"description": "idempotency key is reused with different params",
+				}
+			}
+			if p.Json.Auth {
+				op["security"] = []interface{}{map[string]interface{}{"auth": []string{}}}
+			}
+			if m == "GET" {
+				params := make([]interface{}, len(p.InParamFields))
+				for ix, f := range p.InParamFields {
+					params[ix] = map[string]interface{}{
+						"name":     paramName(f),
+						"in":       "query",
+						"required": isRequired(f),
+						"schema":   fieldSchema(f),
+					}
+				}
+				op["parameters"] = params
+			} else {
+				contentType := "application/x-www-form-urlencoded"
+				if p.HasFiles() {
+					contentType = "multipart/form-data"
+				}
+				op["requestBody"] = map[string]interface{}{
+					"content": map[string]interface{}{
+						contentType: map[string]interface{}{
+							"schema": formSchema(p.InParamFields),
+						},
+					},
+				}
+			}
+			ops[strings.ToLower(m)] = op
+		}
+		paths[p.Json.Url] = ops
+	}
+	schemas["Error"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error": map[string]interface{}{"type": "string"},
+			"code": map[string]interface{}{
+				"type":        "string",
+				"description": "stable code of the error, validation.<rule> for invalid params, unauthorized, method_not_allowed, rate_limited, not_acceptable, body_too_large, bad_body, not_found, internal or idempotency_* for rejected requests, codes of the service otherwise",
+			},
+			"details": map[string]interface{}{"type": "object"},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   receiver,
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"auth": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-Auth",
+				},
+			},
+		},
+	}
+}
+
+func isRequired(f StructField) bool {
+	for _, v := range f.Validators {
+		if v.Name == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldSchema(f StructField) map[string]interface{} {
+	if f.IsFile() {
+		res := map[string]interface{}{"type": "string", "format": "binary"}
+		for _, v := range f.Validators {
+			switch v.Name {
+			case "maxsize":
+				res["description"] = "at most " + strconv.FormatInt(v.Size(), 10) + " bytes"
+			case "mimetype":
+				res["x-mime-types"] = strings.Split(v.Value, "|")
+			}
+		}
+		return res
+	}
+	res := map[string]interface{}{"type": openapiType(f.Type)}
+	for _, v := range f.Validators {
+		n, _ := strconv.Atoi(v.Value)
+		switch {
+		case v.Name == "min" && f.Type == "string":
+			res["minLength"] = n
+		case v.Name == "max" && f.Type == "string":
+			res["maxLength"] = n
+		case v.Name == "min":
+			res["minimum"] = n
+		case v.Name == "max":
+			res["maximum"] = n
+		case v.Name == "enum":
+			res["enum"] = strings.Split(v.Value, "|")
+		case v.Name == "default" && f.Type == "int":
+			res["default"] = n
+		case v.Name == "default":
+			res["default"] = v.Value
+		}
+	}
+	return res
+}
+
+func formSchema(fields []StructField) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := make([]string, 0)
+	for _, f := range fields {
+		props[paramName(f)] = fieldSchema(f)
+		if isRequired(f) {
+			required = append(required, paramName(f))
+		}
+	}
+	res := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) > 0 {
+		res["required"] = required
+	}
+	return res
+}
+
+func openapiType(t string) string {
+	switch {
+	case t == "string":
+		return "string"
+	case t == "bool":
+		return "boolean"
+	case strings.HasPrefix(t, "int"), strings.HasPrefix(t, "uint"):
+		return "integer"
+	case strings.HasPrefix(t, "float"):
+		return "number"
+	}
+	return "object"
+}
+
+// addSchema puts the schema of a struct declared in the parsed file and
+// of all structs it refers to into schemas
+func addSchema(name string, types map[string]*ast.TypeSpec, schemas map[string]interface{}) {
+	if _, ok := schemas[name]; ok {
+		return
+	}
+	ts, ok := types[name]
+	if !ok {
+		schemas[name] = map[string]interface{}{"type": "object"}
+		return
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		schemas[name] = exprSchema(ts.Type, types, schemas)
+		return
+	}
+	props := make(map[string]interface{})
+	schemas[name] = map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			jsonName := n.Name
+			if f.Tag != nil {
+				tag, _ := strconv.Unquote(f.Tag.Value)
+				jsonTag := strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]
+				if jsonTag == "-" {
+					continue
+				}
+				if jsonTag != "" {
+					jsonName = jsonTag
+				}
+			}
+			props[jsonName] = exprSchema(f.Type, types, schemas)
+		}
+	}
+}
+
+func exprSchema(e ast.Expr, types map[string]*ast.TypeSpec, schemas map[string]interface{}) map[string]interface{} {
+	switch t := e.(type) {
+	case *ast.StarExpr:
+		return exprSchema(t.X, types, schemas)
+	case *ast.ArrayType:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": exprSchema(t.Elt, types, schemas),
+		}
+	case *ast.MapType:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": exprSchema(t.Value, types, schemas),
+		}
+	case *ast.Ident:
+		if _, ok := types[t.Name]; ok {
+			addSchema(t.Name, types, schemas)
+			return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name}
+		}
+		return map[string]interface{}{"type": openapiType(t.Name)}
+	}
+	return map[string]interface{}{"type": "object"}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	rateTmpl = template.Must(template.New("rateTmpl").Parse(`
+// rateLimiter is an in-process token bucket per client key
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// allow takes a token of key, if there is none it returns how long to wait for it
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.buckets) > 10000 {
+		// forget clients whose buckets are full again
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateKeyIP identifies clients of rate limited endpoints by address
+func rateKeyIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateKeyAuth identifies clients of rate limited endpoints by auth token,
+// endpoints check it before, so that fake tokens do not get buckets
+func rateKeyAuth(r *http.Request) string {
+	return r.Header.Get("X-Auth")
+}
+`))
+)
+
+// parseRate converts "10/s", "100/m" or "1000/h" to tokens per second
+func parseRate(rate string) (float64, error) {
+	parts := strings.Split(rate, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("rate %q must look like 10/s", rate)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("rate %q must start with a positive number", rate)
+	}
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	}
+	return 0, fmt.Errorf("rate %q must be per s, m or h", rate)
+}
+
+// setupRate checks rate limit options of the endpoint and fills defaults
+func setupRate(api *JsonApi) error {
+	if api.Rate == "" {
+		return nil
+	}
+	rate, err := parseRate(api.Rate)
+	if err != nil {
+		return err
+	}
+	api.RatePerSec = rate
+	if api.Burst <= 0 {
+		api.Burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	switch api.Key {
+	case "":
+		api.Key = "ip"
+	case "ip":
+	case "auth":
+		if !api.Auth {
+			return fmt.Errorf("rate limit key auth needs auth")
+		}
+	default:
+		return fmt.Errorf("rate limit key %q must be ip or auth", api.Key)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// RouterMount is a receiver served by the top-level router at Prefix
+type RouterMount struct {
+	Receiver string
+	Prefix   string
+}
+
+var (
+	routerTmpl = template.Must(template.New("routerTmpl").Funcs(template.FuncMap{
+		"lowerFirst": lowerFirst,
+	}).Parse(`
+// NewRouter serves all receivers from one mux, each at the mount and prefix of
+// its apigen:service annotation. Routes are checked for conflicts when the code is generated,
+// handlers are checked for missing middlewares here.
+func NewRouter({{ range $ix, $m := . }}{{ if $ix }}, {{ end }}{{ $m.Receiver | lowerFirst }} *{{ $m.Receiver }}Handler{{ end }}) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	{{- range $ix, $m := . }}
+	if err := {{ $m.Receiver | lowerFirst }}.RegisterRoutes(mux, "{{ $m.Prefix }}"); err != nil {
+		return nil, err
+	}
+	{{- end }}
+	return mux, nil
+}
+`))
+)
+
+// buildRouter mounts receivers and reports every path served by more than one of them
+func buildRouter(funcDecl map[string][]ApiPoint, services map[string]ServiceApi) ([]RouterMount, error) {
+	mounts := make([]RouterMount, 0, len(funcDecl))
+	owners := make(map[string][]string)
+	for _, receiver := range sortedKeys(funcDecl) {
+		svc := services[receiver]
+		prefix := svc.Mount + svc.Prefix
+		mounts = append(mounts, RouterMount{Receiver: receiver, Prefix: prefix})
+		for _, p := range funcDecl[receiver] {
+			path := prefix + p.Json.Route
+			if p.Json.Version != "" {
+				path = "/" + p.Json.Version + path
+			}
+			owners[path] = append(owners[path], receiver+"."+p.Method)
+		}
+		metas := []string{"/_meta/routes", "/_meta/openapi.json", "/_meta/metrics"}
+		if svc.Batch {
+			metas = append(metas, "/_batch")
+		}
+		for _, meta := range metas {
+			owners[prefix+meta] = append(owners[prefix+meta], receiver+" meta")
+		}
+	}
+	conflicts := make([]string, 0)
+	for path, handlers := range owners {
+		if len(handlers) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("%s is served by %s", path, strings.Join(handlers, ", ")))
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("route conflicts, set \"mount\" in apigen:service to tell them apart:\n\t%s",
+			strings.Join(conflicts, "\n\t"))
+	}
+	return mounts, nil
+}
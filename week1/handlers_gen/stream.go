@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"text/template"
+)
+
+var (
+	streamTmpl = template.Must(template.New("streamTmpl").Parse(`
+// apigenStream writes items of a stream endpoint as ndjson lines or server-sent events
+type apigenStream struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	rc      *http.ResponseController
+	format  string
+	started bool
+}
+
+func newApigenStream(w http.ResponseWriter, r *http.Request, format string) *apigenStream {
+	return &apigenStream{w: w, r: r, rc: http.NewResponseController(w), format: format}
+}
+
+func (s *apigenStream) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	if s.format == "sse" {
+		s.w.Header().Set("Content-Type", "text/event-stream")
+		s.w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// send writes and flushes an item, it fails once the client is gone
+func (s *apigenStream) send(item interface{}) error {
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	s.start()
+	var err error
+	if s.format == "sse" {
+		data, _ := json.Marshal(item)
+		_, err = fmt.Fprintf(s.w, "data: %s\n\n", data)
+	} else {
+		data, _ := json.Marshal(map[string]interface{}{
+			"error":    "",
+			"response": item,
+		})
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// end finishes the stream, an error before the first item is answered like in
+// other endpoints, a later one goes as the final line or error event
+func (s *apigenStream) end(err error) {
+	if err == nil {
+		s.start()
+		return
+	}
+	if s.r.Context().Err() != nil {
+		// nobody listens any more
+		setResult(s.r, "canceled")
+		return
+	}
+	setResult(s.r, "error")
+	if !s.started {
+		writeApiError(s.w, s.r, err)
+		return
+	}
+	info := errorInfoOf(err, messageLanguage(s.r.Header.Get("Accept-Language")))
+	data, _ := json.Marshal(jsonError{Error: info.Message, Code: info.Code, Details: info.Details})
+	if s.format == "sse" {
+		fmt.Fprintf(s.w, "event: error\ndata: %s\n\n", data)
+	} else {
+		fmt.Fprintf(s.w, "%s\n", data)
+	}
+	s.rc.Flush()
+}
+`))
+)
+
+// setupStream checks the stream format of the endpoint and that it goes
+// along with other options
+func setupStream(api *JsonApi) error {
+	switch api.Stream {
+	case "":
+		return nil
+	case "ndjson", "sse":
+	default:
+		return fmt.Errorf("stream %q must be ndjson or sse", api.Stream)
+	}
+	if api.Cache != "" {
+		return fmt.Errorf("streams can not be cached")
+	}
+	if api.Idempotent {
+		return fmt.Errorf("streams can not be idempotent")
+	}
+	return nil
+}
+
+// streamShape tells if a method streams items by returning <-chan T or
+// by taking a send func(T) error callback and returns the type of items
+func streamShape(decl *ast.FuncDecl) (callback bool, item ast.Expr) {
+	params := decl.Type.Params.List
+	if len(params) == 3 {
+		if ft, ok := params[2].Type.(*ast.FuncType); ok && len(ft.Params.List) == 1 {
+			return true, ft.Params.List[0].Type
+		}
+	}
+	results := decl.Type.Results.List
+	if ch, ok := results[0].Type.(*ast.ChanType); ok && ch.Dir == ast.RECV {
+		return false, ch.Value
+	}
+	return false, nil
+}
+
+// typeName is the name of a type used as T or *T
+func typeName(e ast.Expr) string {
+	if star, ok := e.(*ast.StarExpr); ok {
+		e = star.X
+	}
+	return e.(*ast.Ident).Name
+}
+
+// Signature is the params and results of the method of the endpoint
+func (p ApiPoint) Signature() string {
+	if p.Callback {
+		return "(ctx context.Context, in " + p.InParam + ", send func(" + p.ItemType + ") error) error"
+	}
+	return "(ctx context.Context, in " + p.InParam + ") (" + p.OutType + ", error)"
+}
+
+// restPoints leaves endpoints answering with a single response to a plain form,
+// clients know nothing about streams and uploads
+func restPoints(funcDecl map[string][]ApiPoint) map[string][]ApiPoint {
+	res := make(map[string][]ApiPoint)
+	for receiver, points := range funcDecl {
+		for _, p := range points {
+			if p.Json.Stream == "" && !p.HasFiles() {
+				res[receiver] = append(res[receiver], p)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// TestCase is a request to an endpoint and the answer the generated handler must give
+type TestCase struct {
+	Name   string
+	Method string
+	Query  string
+	Auth   string
+	Status int
+	Error  string
+	Field  string
+	Value  string
+	// Files are contents of files sent in a multipart/form-data body by param name
+	Files map[string]string
+}
+
+type TestPoint struct {
+	Point ApiPoint
+	Cases []TestCase
+}
+
+var (
+	testsTmpl = template.Must(template.New("testsTmpl").Parse(`package {{ .Package }}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type apigenCase struct {
+	Name   string
+	Method string
+	Query  string
+	Auth   string
+	Status int
+	Error  string
+	// Field of params must get Value when they reach the service
+	Field string
+	Value string
+	// Files go along with Query in a multipart/form-data body
+	Files map[string]string
+}
+
+// runApigenCases sends every case to a new handler, so that state like rate limits
+// of one case does not affect others
+func runApigenCases(t *testing.T, newHandler func() http.Handler, path string, cases []apigenCase, lastCall func() interface{}) {
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var req *http.Request
+			if c.Method == http.MethodGet {
+				req = httptest.NewRequest(c.Method, path+"?"+c.Query, nil)
+			} else if len(c.Files) > 0 {
+				body := &bytes.Buffer{}
+				mw := multipart.NewWriter(body)
+				values, _ := url.ParseQuery(c.Query)
+				for k, vv := range values {
+					for _, v := range vv {
+						mw.WriteField(k, v)
+					}
+				}
+				for name, content := range c.Files {
+					part, _ := mw.CreateFormFile(name, name)
+					part.Write([]byte(content))
+				}
+				mw.Close()
+				req = httptest.NewRequest(c.Method, path, body)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+			} else {
+				req = httptest.NewRequest(c.Method, path, strings.NewReader(c.Query))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if c.Auth != "" {
+				req.Header.Set("X-Auth", c.Auth)
+			}
+			w := httptest.NewRecorder()
+			newHandler().ServeHTTP(w, req)
+			if w.Code != c.Status {
+				t.Fatalf("expected http status %v, got %v: %s", c.Status, w.Code, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") == "text/event-stream" {
+				// the mock sends a single event
+				if !strings.HasPrefix(w.Body.String(), "data: ") {
+					t.Fatalf("expected an event, got %s", w.Body.String())
+				}
+				return
+			}
+			res := struct {
+				Error *string ` + "`json:\"error\"`" + `
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("cant unpack json: %v", err)
+			}
+			if res.Error == nil || *res.Error != c.Error {
+				t.Fatalf("expected error %q, got %s", c.Error, w.Body.String())
+			}
+			if c.Field != "" {
+				got := fmt.Sprint(reflect.ValueOf(lastCall()).FieldByName(c.Field).Interface())
+				if got != c.Value {
+					t.Fatalf("expected %s to be %q, got %q", c.Field, c.Value, got)
+				}
+			}
+		})
+	}
+}
+
+{{- range $ix, $tp := .Points }}
+{{- $point := $tp.Point }}
+
+func TestApigen{{ $point.Receiver }}{{ $point.Method }}(t *testing.T) {
+	mock := &{{ $point.Receiver }}Mock{
+		{{- if $point.Callback }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			var item {{ $point.ItemType }}
+			return send(item)
+		},
+		{{- else if $point.Json.Stream }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			var item {{ $point.ItemType }}
+			items := make(chan {{ $point.ItemType }}, 1)
+			items <- item
+			close(items)
+			return items, nil
+		},
+		{{- else }}
+		{{ $point.Method }}Func: func{{ $point.Signature }} {
+			return &{{ $point.OutParam }}{}, nil
+		},
+		{{- end }}
+	}
+	cases := []apigenCase{
+	{{- range $ix, $c := $tp.Cases }}
+		{
+			Name:   {{ printf "%q" $c.Name }},
+			Method: "{{ $c.Method }}",
+			Query:  {{ printf "%q" $c.Query }},
+			{{- if $c.Auth }}
+			Auth:   "{{ $c.Auth }}",
+			{{- end }}
+			Status: {{ $c.Status }},
+			Error:  {{ printf "%q" $c.Error }},
+			{{- if $c.Field }}
+			Field:  "{{ $c.Field }}",
+			Value:  {{ printf "%q" $c.Value }},
+			{{- end }}
+			{{- if $c.Files }}
+			Files: map[string]string{
+			{{- range $name, $content := $c.Files }}
+				"{{ $name }}": {{ printf "%q" $content }},
+			{{- end }}
+			},
+			{{- end }}
+		},
+	{{- end }}
+	}
+	newHandler := func() http.Handler {
+		h := New{{ $point.Receiver }}Handler(mock)
+		{{- range $point.Json.Middleware }}
+		h.RegisterMiddleware("{{ . }}", func(next http.Handler) http.Handler { return next })
+		{{- end }}
+		return h
+	}
+	runApigenCases(t, newHandler, "{{ $point.Json.Url }}", cases, func() interface{} {
+		calls := mock.{{ $point.Method }}Calls()
+		return calls[len(calls)-1]
+	})
+}
+{{- end }}
+`))
+)
+
+func genTests(name string, node *ast.File, funcDecl map[string][]ApiPoint) {
+	points := make([]TestPoint, 0)
+	for _, receiver := range sortedKeys(funcDecl) {
+		for _, p := range funcDecl[receiver] {
+			points = append(points, TestPoint{Point: p, Cases: testCases(p)})
+		}
+	}
+	out := &bytes.Buffer{}
+	err := testsTmpl.Execute(out, map[string]interface{}{
+		"Package": node.Name.Name,
+		"Points":  points,
+	})
+	if err != nil {
+		log.Fatalf("Can not generate tests: %v", err)
+	}
+	writeSource(name, out.Bytes())
+}
+
+func sortedKeys(funcDecl map[string][]ApiPoint) []string {
+	res := make([]string, 0, len(funcDecl))
+	for k := range funcDecl {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// testCases derives boundary cases of an endpoint from its params tags.
+// Expected errors mirror the messages of validTmpl and FillValue.
+func testCases(p ApiPoint) []TestCase {
+	method := clientMethod(p)
+	auth := ""
+	if p.Json.Auth {
+		auth = "100500"
+	}
+	valid := url.Values{}
+	files := map[string]string{}
+	for _, f := range p.InParamFields {
+		if f.IsFile() {
+			files[paramName(f)] = validFile(f)
+			continue
+		}
+		valid.Set(paramName(f), validValue(f))
+	}
+	with := func(name, value string) string {
+		v := url.Values{}
+		for k, val := range valid {
+			v[k] = val
+		}
+		v.Set(name, value)
+		return v.Encode()
+	}
+	without := func(name string) string {
+		v := url.Values{}
+		for k, val := range valid {
+			v[k] = val
+		}
+		v.Del(name)
+		return v.Encode()
+	}
+	// withFile sends content as the file name, no file if content is empty
+	withFile := func(name, content string) map[string]string {
+		res := map[string]string{}
+		for k, v := range files {
+			res[k] = v
+		}
+		delete(res, name)
+		if content != "" {
+			res[name] = content
+		}
+		return res
+	}
+	ok := func(name, query string) TestCase {
+		return TestCase{Name: name, Method: method, Query: query, Auth: auth, Status: 200, Files: withFile("", "")}
+	}
+	bad := func(name, query, err string) TestCase {
+		return TestCase{Name: name, Method: method, Query: query, Auth: auth, Status: 400, Error: err, Files: withFile("", "")}
+	}
+
+	res := []TestCase{ok("valid", valid.Encode())}
+	if p.Json.Method != "" {
+		wrong := "POST"
+		if p.Json.Method == "POST" {
+			wrong = "GET"
+		}
+		res = append(res, TestCase{
+			Name: "wrong method", Method: wrong, Query: valid.Encode(), Auth: auth,
+			Status: 406, Error: "bad method",
+		})
+	}
+	if p.Json.Auth {
+		res = append(res,
+			TestCase{Name: "missing auth", Method: method, Query: valid.Encode(), Status: 403, Error: "unauthorized"},
+			TestCase{Name: "wrong auth", Method: method, Query: valid.Encode(), Auth: "wrong", Status: 403, Error: "unauthorized"},
+		)
+	}
+
+	for _, f := range p.InParamFields {
+		pn := paramName(f)
+		ln := strings.ToLower(f.Name)
+		if f.IsFile() {
+			for _, v := range f.Validators {
+				switch v.Name {
+				case "required":
+					c := bad(pn+" missing", valid.Encode(), ln+" must me not empty")
+					c.Files = withFile(pn, "")
+					res = append(res, c)
+				case "mimetype":
+					c := bad(pn+" bad type", valid.Encode(),
+						fmt.Sprintf("%s must be one of [%s]", ln, strings.Join(strings.Split(v.Value, "|"), ", ")))
+					c.Files = withFile(pn, "apigen invalid")
+					res = append(res, c)
+				}
+			}
+			continue
+		}
+		if f.Type == "int" {
+			res = append(res, bad(pn+" not int", with(pn, "x"), pn+" must be int"))
+		}
+		for _, v := range f.Validators {
+			n, _ := strconv.Atoi(v.Value)
+			switch v.Name {
+			case "required":
+				if f.Type == "int" {
+					res = append(res, bad(pn+" missing", without(pn), pn+" must be int"))
+				} else {
+					res = append(res, bad(pn+" missing", without(pn), ln+" must me not empty"))
+				}
+			case "min":
+				if f.Type == "int" {
+					res = append(res,
+						withField(ok(pn+" min", with(pn, v.Value)), f.Name, v.Value),
+						bad(pn+" min-1", with(pn, strconv.Itoa(n-1)), fmt.Sprintf("%s must be >= %d", ln, n)),
+					)
+				} else if n > 1 || (n == 1 && !isRequired(f)) {
+					res = append(res,
+						withField(ok(pn+" min len", with(pn, strings.Repeat("a", n))), f.Name, strings.Repeat("a", n)),
+						bad(pn+" min len-1", with(pn, strings.Repeat("a", n-1)), fmt.Sprintf("%s len must be >= %d", ln, n)),
+					)
+				}
+			case "max":
+				if f.Type == "int" {
+					res = append(res,
+						withField(ok(pn+" max", with(pn, v.Value)), f.Name, v.Value),
+						bad(pn+" max+1", with(pn, strconv.Itoa(n+1)), fmt.Sprintf("%s must be <= %d", ln, n)),
+					)
+				} else {
+					res = append(res,
+						withField(ok(pn+" max len", with(pn, strings.Repeat("a", n))), f.Name, strings.Repeat("a", n)),
+						bad(pn+" max len+1", with(pn, strings.Repeat("a", n+1)), fmt.Sprintf("%s len must be <= %d", ln, n)),
+					)
+				}
+			case "enum":
+				members := strings.Split(v.Value, "|")
+				for _, m := range members {
+					res = append(res, withField(ok(pn+" "+m, with(pn, m)), f.Name, m))
+				}
+				res = append(res, bad(pn+" not in enum", with(pn, "apigen_invalid"),
+					fmt.Sprintf("%s must be one of [%s]", ln, strings.Join(members, ", "))))
+			case "default":
+				res = append(res, withField(ok(pn+" default", without(pn)), f.Name, v.Value))
+			}
+		}
+	}
+	return res
+}
+
+func withField(c TestCase, field, value string) TestCase {
+	c.Field = field
+	c.Value = value
+	return c
+}
+
+// mimeMagic are beginnings of files sniffed as the mime types
+var mimeMagic = map[string]string{
+	"image/png":       "\x89PNG\r\n\x1a\n",
+	"image/jpeg":      "\xff\xd8\xff",
+	"image/gif":       "GIF89a",
+	"application/pdf": "%PDF-",
+}
+
+// validFile is the content of a file passing mimetype of the field
+func validFile(f StructField) string {
+	for _, v := range f.Validators {
+		if v.Name != "mimetype" {
+			continue
+		}
+		for _, t := range strings.Split(v.Value, "|") {
+			if magic, ok := mimeMagic[t]; ok {
+				return magic
+			}
+		}
+	}
+	return "apigen file"
+}
+
+// validValue is a value of the field passing all its validators
+func validValue(f StructField) string {
+	min, max := 0, 0
+	hasMin, hasMax := false, false
+	for _, v := range f.Validators {
+		n, _ := strconv.Atoi(v.Value)
+		switch v.Name {
+		case "enum":
+			return strings.Split(v.Value, "|")[0]
+		case "min":
+			min, hasMin = n, true
+		case "max":
+			max, hasMax = n, true
+		}
+	}
+	if f.Type == "int" {
+		if hasMin {
+			return strconv.Itoa(min)
+		}
+		if hasMax && max < 0 {
+			return strconv.Itoa(max)
+		}
+		return "0"
+	}
+	if min < 1 {
+		min = 1
+	}
+	if hasMax && min > max {
+		min = max
+	}
+	return strings.Repeat("a", min)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+type TSData struct {
+	Params    []TSInterface
+	Results   []TSInterface
+	Receivers map[string][]ApiPoint
+}
+
+type TSInterface struct {
+	Name   string
+	Fields []TSField
+}
+
+type TSField struct {
+	Name     string
+	Type     string
+	Optional bool
+}
+
+var (
+	tsTmpl = template.Must(template.New("tsTmpl").Funcs(template.FuncMap{
+		"lowerFirst":   lowerFirst,
+		"clientMethod": clientMethod,
+	}).Parse(`export class ApiError extends Error {
+  constructor(
+    public readonly status: number,
+    message: string,
+    public readonly code?: string,
+    public readonly details?: Record<string, unknown>,
+  ) {
+    super(message);
+    this.name = "ApiError";
+  }
+}
+{{- range $ix, $i := .Params }}
+
+export interface {{ $i.Name }} {
+{{- range $ix, $f := $i.Fields }}
+  {{ $f.Name }}{{ if $f.Optional }}?{{ end }}: {{ $f.Type }};
+{{- end }}
+}
+{{- end }}
+{{- range $ix, $i := .Results }}
+
+export interface {{ $i.Name }} {
+{{- range $ix, $f := $i.Fields }}
+  {{ $f.Name }}{{ if $f.Optional }}?{{ end }}: {{ $f.Type }};
+{{- end }}
+}
+{{- end }}
+
+interface Envelope<T> {
+  error: string;
+  code?: string;
+  details?: Record<string, unknown>;
+  response?: T;
+}
+
+async function call<T>(baseUrl: string, method: string, url: string, params: object, auth?: string): Promise<T> {
+  const query = new URLSearchParams();
+  for (const [k, v] of Object.entries(params)) {
+    if (v !== undefined && v !== null) {
+      query.append(k, String(v));
+    }
+  }
+  const headers: Record<string, string> = {};
+  if (auth !== undefined) {
+    headers["X-Auth"] = auth;
+  }
+  let resp: Response;
+  if (method === "GET") {
+    resp = await fetch(baseUrl + url + "?" + query.toString(), { method, headers });
+  } else {
+    headers["Content-Type"] = "application/x-www-form-urlencoded";
+    resp = await fetch(baseUrl + url, { method, headers, body: query });
+  }
+  let env: Envelope<T>;
+  try {
+    env = await resp.json();
+  } catch (e) {
+    throw new ApiError(resp.status, "bad response: " + e);
+  }
+  if (!resp.ok || env.error !== "") {
+    throw new ApiError(resp.status, env.error, env.code, env.details);
+  }
+  return env.response as T;
+}
+{{- range $receiver, $points := .Receivers }}
+
+export class {{ $receiver }}Client {
+  constructor(private readonly baseUrl: string, private readonly auth?: string) {}
+{{- range $ix, $point := $points }}
+{{ with $point.Json.Deprecated }}
+  /** @deprecated {{ $point.Json.Url }} goes away{{ if .Sunset }} on {{ .Sunset }}{{ end }}{{ if .Replacement }}, use {{ .Replacement }} instead{{ end }} */
+{{- end }}
+  {{ $point.Method | lowerFirst }}(params: {{ $point.InParam }}): Promise<{{ $point.OutParam }}> {
+    return call<{{ $point.OutParam }}>(this.baseUrl, "{{ $point | clientMethod }}", "{{ $point.Json.Url }}", params{{ if $point.Json.Auth }}, this.auth{{ end }});
+  }
+{{- end }}
+}
+{{- end }}
+`))
+)
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func genTypeScript(name string, node *ast.File, funcDecl map[string][]ApiPoint) {
+	types := findTypeSpecs(node)
+	used := usedTypes(node, funcDecl)
+	data := TSData{
+		Params:    make([]TSInterface, 0),
+		Results:   make([]TSInterface, 0),
+		Receivers: funcDecl,
+	}
+	params := make(map[string]bool)
+	for _, points := range funcDecl {
+		for _, p := range points {
+			if params[p.InParam] {
+				continue
+			}
+			params[p.InParam] = true
+			data.Params = append(data.Params, tsParams(p))
+		}
+	}
+	for tn := range used {
+		if params[tn] {
+			continue
+		}
+		if st, ok := types[tn].Type.(*ast.StructType); ok {
+			data.Results = append(data.Results, tsStruct(tn, st, types))
+		}
+	}
+	sort.Slice(data.Params, func(i, j int) bool { return data.Params[i].Name < data.Params[j].Name })
+	sort.Slice(data.Results, func(i, j int) bool { return data.Results[i].Name < data.Results[j].Name })
+	out := &bytes.Buffer{}
+	if err := tsTmpl.Execute(out, data); err != nil {
+		log.Fatalf("Can not generate typescript: %v", err)
+	}
+	if err := os.WriteFile(name, out.Bytes(), 0644); err != nil {
+		log.Fatalf("Can not write %s: %v", name, err)
+	}
+}
+
+// tsParams describes params as they are sent over the wire, by their param names
+func tsParams(p ApiPoint) TSInterface {
+	res := TSInterface{Name: p.InParam}
+	for _, f := range p.InParamFields {
+		field := TSField{
+			Name: paramName(f),
+			Type: tsIdentType(f.Type),
+			// int params can not be omitted, the server fails to parse an empty value
+			Optional: !isRequired(f) && f.Type == "string",
+		}
+		for _, v := range f.Validators {
+			if v.Name == "enum" {
+				members := strings.Split(v.Value, "|")
+				for ix, m := range members {
+					members[ix] = strconv.Quote(m)
+				}
+				field.Type = strings.Join(members, " | ")
+			}
+		}
+		res.Fields = append(res.Fields, field)
+	}
+	return res
+}
+
+// tsStruct describes a result struct by its json names
+func tsStruct(name string, st *ast.StructType, types map[string]*ast.TypeSpec) TSInterface {
+	res := TSInterface{Name: name}
+	for _, f := range st.Fields.List {
+		for _, n := range f.Names {
+			if !n.IsExported() {
+				continue
+			}
+			field := TSField{
+				Name: n.Name,
+				Type: tsType(f.Type, types),
+			}
+			if f.Tag != nil {
+				tag, _ := strconv.Unquote(f.Tag.Value)
+				parts := strings.Split(reflect.StructTag(tag).Get("json"), ",")
+				if parts[0] == "-" {
+					continue
+				}
+				if parts[0] != "" {
+					field.Name = parts[0]
+				}
+				for _, opt := range parts[1:] {
+					if opt == "omitempty" {
+						field.Optional = true
+					}
+				}
+			}
+			res.Fields = append(res.Fields, field)
+		}
+	}
+	return res
+}
+
+func tsType(e ast.Expr, types map[string]*ast.TypeSpec) string {
+	switch t := e.(type) {
+	case *ast.StarExpr:
+		return tsType(t.X, types) + " | null"
+	case *ast.ArrayType:
+		return "Array<" + tsType(t.Elt, types) + ">"
+	case *ast.MapType:
+		return "Record<string, " + tsType(t.Value, types) + ">"
+	case *ast.Ident:
+		if ts, ok := types[t.Name]; ok {
+			if _, ok := ts.Type.(*ast.StructType); ok {
+				return t.Name
+			}
+			return tsType(ts.Type, types)
+		}
+		return tsIdentType(t.Name)
+	}
+	return "unknown"
+}
+
+func tsIdentType(t string) string {
+	switch openapiType(t) {
+	case "string":
+		return "string"
+	case "boolean":
+		return "boolean"
+	case "integer", "number":
+		return "number"
+	}
+	return "unknown"
+}
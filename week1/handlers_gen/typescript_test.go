@@ -0,0 +1,46 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTypeScriptGolden generates the client of the api of week1 and compares
+// it with api.ts, go generate updates both
+func TestTypeScriptGolden(t *testing.T) {
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, "../api.go", nil, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("cant parse api: %v", err)
+	}
+	funcDecl := findFuncDecl(node, findServices(node))
+	out := filepath.Join(t.TempDir(), "api.ts")
+	genTypeScript(out, node, restPoints(funcDecl))
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("cant read generated client: %v", err)
+	}
+	golden, err := os.ReadFile("../api.ts")
+	if err != nil {
+		t.Fatalf("cant read golden client: %v", err)
+	}
+	gotLines := strings.Split(string(got), "\n")
+	goldenLines := strings.Split(string(golden), "\n")
+	for ix := 0; ix < len(gotLines) || ix < len(goldenLines); ix++ {
+		gotLine, goldenLine := "", ""
+		if ix < len(gotLines) {
+			gotLine = gotLines[ix]
+		}
+		if ix < len(goldenLines) {
+			goldenLine = goldenLines[ix]
+		}
+		if gotLine != goldenLine {
+			t.Fatalf("api.ts differs at line %d, run go generate:\nexpected %q\ngot      %q", ix+1, goldenLine, gotLine)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	uploadTmpl = template.Must(template.New("uploadTmpl").Parse(`
+// FillFile reads a file of a multipart/form-data request into *multipart.FileHeader
+// or []byte, a missing file is nil
+func FillFile(n, t string, r *http.Request) (interface{}, *ApiError) {
+	n = strings.ToLower(n)
+	bad := &ApiError{
+		HTTPStatus: http.StatusBadRequest,
+		Err:        newValidationError(n, "type", "type", n, "file"),
+	}
+	file, header, err := r.FormFile(n)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		if t == "[]byte" {
+			return []byte(nil), nil
+		}
+		return (*multipart.FileHeader)(nil), nil
+	}
+	if err != nil {
+		return nil, bad
+	}
+	defer file.Close()
+	if t != "[]byte" {
+		return header, nil
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, bad
+	}
+	return data, nil
+}
+
+// hasMimeType tells if the content of a file sniffs as one of types
+func hasMimeType(file interface{}, types []string) bool {
+	var head []byte
+	switch f := file.(type) {
+	case []byte:
+		head = f
+	case *multipart.FileHeader:
+		r, err := f.Open()
+		if err != nil {
+			return false
+		}
+		defer r.Close()
+		head = make([]byte, 512)
+		n, _ := io.ReadFull(r, head)
+		head = head[:n]
+	}
+	mimeType := http.DetectContentType(head)
+	if ix := strings.Index(mimeType, ";"); ix >= 0 {
+		mimeType = mimeType[:ix]
+	}
+	for _, t := range types {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+`))
+)
+
+// IsFile tells if the field is bound from a file of a multipart/form-data request
+func (f StructField) IsFile() bool {
+	return f.Type == "*multipart.FileHeader" || f.Type == "[]byte"
+}
+
+// Size is the value of a maxsize validator in bytes
+func (v Validator) Size() int64 {
+	n, _ := parseSize(v.Value)
+	return n
+}
+
+// parseSize parses sizes like 512, 100KB or 5MB
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.ToUpper(strings.TrimSpace(s))
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of B, KB, MB or GB", s)
+	}
+	return n * mult, nil
+}
+
+// checkFileValidators makes sure maxsize and mimetype go with files only
+func checkFileValidators(structName string, f StructField) error {
+	for _, v := range f.Validators {
+		switch v.Name {
+		case "maxsize", "mimetype":
+			if !f.IsFile() {
+				return fmt.Errorf("%s.%s: %s is for files only", structName, f.Name, v.Name)
+			}
+		}
+		if v.Name == "maxsize" {
+			if _, err := parseSize(v.Value); err != nil {
+				return fmt.Errorf("%s.%s: %v", structName, f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// HasFiles tells if the endpoint takes files
+func (p ApiPoint) HasFiles() bool {
+	for _, f := range p.InParamFields {
+		if f.IsFile() {
+			return true
+		}
+	}
+	return false
+}
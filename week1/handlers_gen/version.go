@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DeprecatedApi marks an endpoint going away at Sunset in favor of Replacement
+type DeprecatedApi struct {
+	Sunset      string `json:"sunset"`
+	Replacement string `json:"replacement,omitempty"`
+	// SunsetHeader is Sunset as an http date
+	SunsetHeader string `json:"-"`
+}
+
+var (
+	versionTmpl = template.Must(template.New("versionTmpl").Parse(`
+// splitVersion cuts one of versions off the path, /v2/user/create gives /v2 and /user/create
+func splitVersion(path string, versions []string) (string, string) {
+	for _, v := range versions {
+		if strings.HasPrefix(path, "/"+v+"/") {
+			return "/" + v, path[len(v)+1:]
+		}
+	}
+	return "", path
+}
+
+// setDeprecated tells clients that the endpoint is going away
+func setDeprecated(w http.ResponseWriter, sunset, replacement string) {
+	w.Header().Set("Deprecation", "true")
+	if sunset != "" {
+		w.Header().Set("Sunset", sunset)
+	}
+	if replacement != "" {
+		w.Header().Add("Link", "<"+replacement+">; rel=\"successor-version\"")
+	}
+}
+`))
+)
+
+// RouteKey is what the router matches an endpoint by: its version and url relative to the prefix
+func (a *JsonApi) RouteKey() string {
+	if a.Version == "" {
+		return a.Route
+	}
+	return "/" + a.Version + a.Route
+}
+
+// versions lists versions of the endpoints in the order of their first use
+func versions(points []ApiPoint) []string {
+	res := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, p := range points {
+		if p.Json.Version != "" && !seen[p.Json.Version] {
+			seen[p.Json.Version] = true
+			res = append(res, p.Json.Version)
+		}
+	}
+	return res
+}
+
+// setupVersion checks version and deprecation of the endpoint
+func setupVersion(api *JsonApi) error {
+	if api.Version != "" && (strings.ContainsAny(api.Version, "/ ") || strings.HasPrefix(api.Version, "_")) {
+		return fmt.Errorf("version %q must be a single path segment", api.Version)
+	}
+	if api.Deprecated == nil {
+		return nil
+	}
+	if api.Deprecated.Sunset != "" {
+		t, err := time.Parse("2006-01-02", api.Deprecated.Sunset)
+		if err != nil {
+			return fmt.Errorf("sunset %q must be a date like 2027-01-01", api.Deprecated.Sunset)
+		}
+		api.Deprecated.SunsetHeader = t.UTC().Format(http.TimeFormat)
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package week1
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -75,7 +81,9 @@ func TestMyApi(t *testing.T) {
 			Query:  "",
 			Status: http.StatusBadRequest,
 			Result: CR{
-				"error": "login must me not empty",
+				"error":   "login must me not empty",
+				"code":    "validation.required",
+				"details": CR{"field": "login"},
 			},
 		},
 		Case{ // получили ошибку общего назначения - ваш код сам подставил 500
@@ -92,6 +100,7 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusNotFound,
 			Result: CR{
 				"error": "user not exist",
+				"code":  "user_not_found",
 			},
 		},
 		// ------
@@ -101,6 +110,7 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusNotFound,
 			Result: CR{
 				"error": "unknown method",
+				"code":  "not_found",
 			},
 		},
 		// ------
@@ -139,6 +149,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "bad method",
+				"code":  "method_not_allowed",
 			},
 		},
 		Case{
@@ -149,6 +160,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   false,
 			Result: CR{
 				"error": "unauthorized",
+				"code":  "unauthorized",
 			},
 		},
 		Case{
@@ -158,7 +170,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusConflict,
 			Auth:   true,
 			Result: CR{
-				"error": "user mr.moderator exist",
+				"error":   "user mr.moderator exist",
+				"code":    "user_exists",
+				"details": CR{"login": "mr.moderator"},
 			},
 		},
 		Case{
@@ -168,7 +182,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "login must me not empty",
+				"error":   "login must me not empty",
+				"code":    "validation.required",
+				"details": CR{"field": "login"},
 			},
 		},
 		Case{
@@ -178,7 +194,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "login len must be >= 10",
+				"error":   "login len must be >= 10",
+				"code":    "validation.min",
+				"details": CR{"field": "login"},
 			},
 		},
 		Case{
@@ -188,7 +206,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be int",
+				"error":   "age must be int",
+				"code":    "validation.type",
+				"details": CR{"field": "age"},
 			},
 		},
 		Case{
@@ -198,7 +218,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be >= 0",
+				"error":   "age must be >= 0",
+				"code":    "validation.min",
+				"details": CR{"field": "age"},
 			},
 		},
 		Case{
@@ -208,7 +230,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be <= 128",
+				"error":   "age must be <= 128",
+				"code":    "validation.max",
+				"details": CR{"field": "age"},
 			},
 		},
 		Case{
@@ -218,7 +242,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "status must be one of [user, moderator, admin]",
+				"error":   "status must be one of [user, moderator, admin]",
+				"code":    "validation.enum",
+				"details": CR{"field": "status"},
 			},
 		},
 		Case{ // status по-умолчанию
@@ -260,7 +286,9 @@ func TestOtherApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "class must be one of [warrior, sorcerer, rouge]",
+				"error":   "class must be one of [warrior, sorcerer, rouge]",
+				"code":    "validation.enum",
+				"details": CR{"field": "class"},
 			},
 		},
 		Case{
@@ -282,6 +310,18 @@ func TestOtherApi(t *testing.T) {
 	}
 
 	runTests(t, ts, cases)
+
+	// the receiver keeps its handler between requests
+	resp, err := client.Get(ts.URL + "/user/_meta/metrics")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	line := `apigen_requests_total{receiver="OtherApi",endpoint="/user/create",status="200",result="ok"} 1`
+	if !strings.Contains(string(body), line+"\n") {
+		t.Errorf("no %s in metrics:\n%s", line, body)
+	}
 }
 
 func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
@@ -341,3 +381,1178 @@ func runTests(t *testing.T, ts *httptest.Server, cases []Case) {
 		}
 	}
 }
+
+func TestApiMeta(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + "/user/_meta/routes")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	routes := struct {
+		Receiver string
+		Routes   []struct {
+			Url     string
+			Methods []string
+			Auth    bool
+		}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+		t.Fatalf("cant unpack json: %v", err)
+	}
+	if routes.Receiver != "MyApi" || len(routes.Routes) != 6 {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+	if r := routes.Routes[2]; r.Url != ApiUserCreate || !r.Auth || !reflect.DeepEqual(r.Methods, []string{"POST"}) {
+		t.Errorf("unexpected create route: %+v", r)
+	}
+
+	resp, err = client.Get(ts.URL + "/user/_meta/openapi.json")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	doc := struct {
+		Paths map[string]map[string]interface{}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("cant unpack json: %v", err)
+	}
+	if _, ok := doc.Paths[ApiUserCreate]["post"]; !ok {
+		t.Errorf("post %s not described: %+v", ApiUserCreate, doc.Paths)
+	}
+}
+
+func TestMyApiMock(t *testing.T) {
+	mock := &MyApiMock{
+		CreateFunc: func(ctx context.Context, in CreateParams) (*NewUser, error) {
+			return &NewUser{ID: 1}, nil
+		},
+	}
+	h := NewMyApiHandler(mock)
+	h.RegisterMiddleware("nostore", noStore)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=mr.moderator&age=32&status=moderator&full_name=Ivan_Ivanov",
+			Status: http.StatusOK,
+			Auth:   true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id": 1,
+				},
+			},
+		},
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusInternalServerError,
+			Result: CR{
+				"error": "MyApiMock.Profile is not stubbed",
+			},
+		},
+	}
+	runTests(t, ts, cases)
+
+	expected := []CreateParams{{Login: "mr.moderator", Name: "Ivan_Ivanov", Status: "moderator", Age: 32}}
+	if calls := mock.CreateCalls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected Create calls: %+v", calls)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	mock := &MyApiMock{
+		ProfileFunc: func(ctx context.Context, in ProfileParams) (*User, error) {
+			panic("secret details")
+		},
+	}
+	ts := httptest.NewServer(NewMyApiHandler(mock))
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusInternalServerError,
+			Result: CR{
+				"error": "internal error",
+				"code":  "internal",
+			},
+		},
+	}
+	runTests(t, ts, cases)
+
+	// a started stream is ended without an error appended
+	mock.FeedFunc = func(ctx context.Context, in ExportParams, send func(*User) error) error {
+		send(&User{ID: 1})
+		panic("secret details")
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/user/feed?limit=0", nil)
+	req.Header.Set("X-Auth", "100500")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expected := `data: {"id":1,"login":"","full_name":"","status":0}` + "\n\n"
+	if resp.StatusCode != http.StatusOK || string(body) != expected {
+		t.Errorf("expected %q, got %v %q", expected, resp.StatusCode, body)
+	}
+
+	// http.ErrAbortHandler goes on to the server
+	mock.ProfileFunc = func(ctx context.Context, in ProfileParams) (*User, error) {
+		panic(http.ErrAbortHandler)
+	}
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler, got %v", rec)
+		}
+	}()
+	NewMyApiHandler(mock).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil))
+}
+
+func TestMiddleware(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	// middleware runs before auth check
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("nostore middleware not applied: %v %v", resp.StatusCode, resp.Header)
+	}
+
+	// a middleware that is not registered is a setup error
+	h := NewMyApiHandler(NewMyApi())
+	expected := "MyApi: middleware nostore is not registered"
+	if err := h.Check(); err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if _, err := NewRouter(h, NewOtherApiHandler(NewOtherApi())); err == nil || err.Error() != expected {
+		t.Errorf("expected router error %q, got %v", expected, err)
+	}
+	h.RegisterMiddleware("nostore", noStore)
+	if err := h.Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	for i := 0; i < 30; i++ {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			continue
+		}
+		if i < 20 {
+			t.Errorf("limited after %d requests, burst is 20", i)
+		}
+		if resp.Header.Get("Retry-After") != "1" {
+			t.Errorf("bad Retry-After: %q", resp.Header.Get("Retry-After"))
+		}
+		return
+	}
+	t.Errorf("no rate limit after 30 requests")
+}
+
+func TestRateLimitByAuth(t *testing.T) {
+	api := NewOtherApi()
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	create := func(auth string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, nil)
+		req.Header.Set("X-Auth", auth)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// fake tokens are rejected before they get buckets of their own
+	for i := 0; i < 10; i++ {
+		if status := create(fmt.Sprintf("fake%d", i)); status != http.StatusForbidden {
+			t.Fatalf("expected 403 for a fake token, got %v", status)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if status := create("100500"); status == http.StatusTooManyRequests {
+			t.Fatalf("limited after %d requests, burst is 5", i)
+		}
+	}
+	if status := create("100500"); status != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after burst, got %v", status)
+	}
+	if n := len(api.Handler().limiterCreate.buckets); n != 1 {
+		t.Errorf("expected a bucket of the valid token only, got %d", n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	for _, query := range []string{"login=rvasily", "", "login=bad_user"} {
+		resp, err := client.Get(ts.URL + ApiUserProfile + "?" + query)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := client.Get(ts.URL + "/user/_meta/metrics")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, line := range []string{
+		`apigen_requests_total{receiver="MyApi",endpoint="/user/profile",status="200",result="ok"} 1`,
+		`apigen_requests_total{receiver="MyApi",endpoint="/user/profile",status="400",result="invalid"} 1`,
+		`apigen_requests_total{receiver="MyApi",endpoint="/user/profile",status="500",result="error"} 1`,
+		`apigen_request_duration_seconds_count{receiver="MyApi",endpoint="/user/profile"} 3`,
+		`apigen_requests_in_flight{receiver="MyApi",endpoint="/user/profile"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("no %s in metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var ctxID string
+	mock := &MyApiMock{
+		ProfileFunc: func(ctx context.Context, in ProfileParams) (*User, error) {
+			ctxID = RequestID(ctx)
+			return &User{}, nil
+		},
+	}
+	logs := &strings.Builder{}
+	h := NewMyApiHandler(mock)
+	h.AccessLog = log.New(logs, "", 0)
+	h.RegisterMiddleware("nostore", noStore)
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Request-Id") != "req-1" || ctxID != "req-1" {
+		t.Errorf("request id not passed: header %q, context %q", resp.Header.Get("X-Request-Id"), ctxID)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader("login=short&age=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth", "100500")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Request-Id") == "" {
+		t.Errorf("request id not generated")
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", logs.String())
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("cant unpack log line: %v", err)
+	}
+	for k, v := range map[string]interface{}{
+		"request_id": resp.Header.Get("X-Request-Id"),
+		"endpoint":   ApiUserCreate,
+		"method":     http.MethodPost,
+		"status":     float64(http.StatusBadRequest),
+		"result":     "invalid",
+		"field":      "login",
+		"rule":       "min",
+	} {
+		if entry[k] != v {
+			t.Errorf("expected %s %v in log, got %v", k, v, entry[k])
+		}
+	}
+	if p, _ := entry["principal"].(string); !strings.HasPrefix(p, "token:") || strings.Contains(p, "100500") {
+		t.Errorf("bad principal in log: %q", p)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Fatalf("no caching headers: %v", resp.Header)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("expected 304 without body, got %v %q", resp.StatusCode, body)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for changed etag, got %v", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	create := func(key, query, accept string) (int, string, http.Header) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader(query))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		req.Header.Set("Idempotency-Key", key)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header
+	}
+
+	status, first, _ := create("k1", "login=idempotent&age=32", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %s", status, first)
+	}
+	status, repeat, header := create("k1", "login=idempotent&age=32", "")
+	if status != http.StatusOK || repeat != first || header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replay of %s, got %v %s %v", first, status, repeat, header)
+	}
+	status, body, _ := create("k1", "login=idempotent&age=33", "")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for other params, got %v: %s", status, body)
+	}
+	status, body, _ = create("k1", "login=idempotent&age=32", "application/xml")
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for other format, got %v: %s", status, body)
+	}
+	status, body, _ = create("k1", "login=idempotent&age=32", "application/json, text/plain;q=0.5")
+	if status != http.StatusOK || body != first {
+		t.Errorf("expected replay of %s for same format, got %v: %s", first, status, body)
+	}
+	status, body, _ = create("k2", "login=idempotent&age=32", "")
+	if status != http.StatusConflict {
+		t.Errorf("expected 409 for new key, got %v: %s", status, body)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	store.MaxItems = 2
+	for _, key := range []string{"a", "b", "a", "c"} {
+		store.Put(key, &IdempotentResponse{Status: http.StatusOK}, time.Hour)
+	}
+	// a is put again after b, so b is the oldest one
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := store.Get(key); ok != kept {
+			t.Errorf("expected %s to be kept %v", key, kept)
+		}
+	}
+	if len(store.items) != 2 {
+		t.Errorf("expected 2 items, got %d", len(store.items))
+	}
+
+	store.Put("old", &IdempotentResponse{Status: http.StatusOK}, -time.Second)
+	store.Put("new", &IdempotentResponse{Status: http.StatusOK}, time.Hour)
+	if _, ok := store.items["old"]; ok {
+		t.Errorf("expired item is kept")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	preflight := func(path, origin, method, headers string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight(ApiUserCreate, "https://app.example.com", "POST", "x-auth, content-type")
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "POST" ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" ||
+		resp.Header.Get("Allow") != "POST, OPTIONS" {
+		t.Errorf("bad preflight of receiver policy: %v %v", resp.StatusCode, resp.Header)
+	}
+	resp = preflight(ApiUserCreate, "https://evil.example.com", "POST", "")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of other origin is allowed: %v %v", resp.StatusCode, resp.Header)
+	}
+	resp = preflight(ApiUserCreate, "https://app.example.com", "POST", "X-Secret")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of not allowed header is allowed: %v", resp.Header)
+	}
+	resp = preflight(ApiUserProfile, "https://any.example.com", "GET", "")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("bad preflight of endpoint policy: %v", resp.Header)
+	}
+	resp = preflight("/user/unknown", "https://app.example.com", "GET", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown url, got %v", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	req.Header.Set("Origin", "https://any.example.com")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "*" ||
+		resp.Header.Get("Access-Control-Expose-Headers") != "ETag, Deprecation, Sunset, Link" {
+		t.Errorf("no cors headers in response: %v %v", resp.StatusCode, resp.Header)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	expose := "X-Request-Id, ETag, Retry-After, Deprecation, Sunset, Link, Idempotent-Replayed"
+	if resp.Header.Get("Access-Control-Expose-Headers") != expose {
+		t.Errorf("expected default exposed headers %q, got %v", expose, resp.Header)
+	}
+
+	// responses without Origin are safe to cache for cross-origin requests
+	resp, err = client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected * for any origin policy, got %v", resp.Header)
+	}
+	resp, err = client.Post(ts.URL+ApiUserCreate, "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Vary") != "Origin" || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected Vary: Origin without allow origin, got %v", resp.Header)
+	}
+}
+
+func TestMountPrefix(t *testing.T) {
+	api := NewMyApi()
+	api.Handler().Prefix = "/v1/user"
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{
+			Path:   "/v1/user/profile",
+			Query:  "login=rvasily",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error": "unknown method",
+				"code":  "not_found",
+			},
+		},
+	})
+
+	resp, err := client.Get(ts.URL + "/v1/user/_meta/routes")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected meta under the prefix, got %v", resp.StatusCode)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router, err := NewRouter(NewMyApi().Handler(), NewOtherApiHandler(NewOtherApi()))
+	if err != nil {
+		t.Fatalf("router error: %v", err)
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	runTests(t, ts, []Case{
+		Case{
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+				},
+			},
+		},
+		Case{
+			Path:   "/other" + ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "username=moderator&level=1",
+			Status: http.StatusOK,
+			Auth:   true,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        12,
+					"login":     "moderator",
+					"full_name": "",
+					"level":     1,
+				},
+			},
+		},
+	})
+
+	resp, err := client.Get(ts.URL + "/other/user/_meta/routes")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"receiver":"OtherApi"`) {
+		t.Errorf("expected OtherApi routes, got %v %s", resp.StatusCode, body)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Deprecation") != "true" ||
+		resp.Header.Get("Sunset") != "Fri, 01 Jan 2027 00:00:00 GMT" ||
+		resp.Header.Get("Link") != `</v2/user/profile>; rel="successor-version"` {
+		t.Errorf("bad deprecation headers: %v", resp.Header)
+	}
+
+	resp, err = client.Get(ts.URL + "/v2" + ApiUserProfile + "?login=rvasily")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") != "" {
+		t.Errorf("bad answer of v2: %v %v %s", resp.StatusCode, resp.Header, body)
+	}
+
+	resp, err = client.Get(ts.URL + "/user/_meta/metrics")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `apigen_deprecated_requests_total{receiver="MyApi",endpoint="/user/profile"} 1`) {
+		t.Errorf("deprecated request is not counted:\n%s", body)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	ts := httptest.NewServer(NewJSONRPCHandler(NewMyApi().Handler(), NewOtherApiHandler(NewOtherApi())))
+	defer ts.Close()
+
+	rpc := func(body string, auth bool) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if auth {
+			req.Header.Set("X-Auth", "100500")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		res, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(res)
+	}
+	check := func(body string, auth bool, expected interface{}) {
+		t.Helper()
+		status, res := rpc(body, auth)
+		var got interface{}
+		if err := json.Unmarshal([]byte(res), &got); err != nil {
+			t.Fatalf("cant unpack json of %v %q: %v", status, res, err)
+		}
+		var want interface{}
+		data, _ := json.Marshal(expected)
+		json.Unmarshal(data, &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("for %s expected %s, got %s", body, data, res)
+		}
+	}
+
+	check(`{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "rvasily"}, "id": 1}`, false, CR{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"result": CR{
+			"id":        42,
+			"login":     "rvasily",
+			"full_name": "Vasily Romanov",
+			"status":    20,
+		},
+	})
+	check(`{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator"}, "id": "c"}`, false, CR{
+		"jsonrpc": "2.0",
+		"id":      "c",
+		"error":   CR{"code": -32000, "message": "unauthorized", "data": CR{"status": 403, "code": "unauthorized"}},
+	})
+	check(`[
+		{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32, "status": "moderator"}, "id": 1},
+		{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "x", "age": 32}, "id": 2},
+		{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.admin", "age": "32"}, "id": 3},
+		{"jsonrpc": "2.0", "method": "OtherApi.Create", "params": {"username": "moderator", "level": 1}},
+		{"jsonrpc": "2.0", "method": "MyApi.Delete", "id": 4},
+		{"jsonrpc": "1.0", "method": "MyApi.Create", "id": 5}
+	]`, true, []interface{}{
+		CR{"jsonrpc": "2.0", "id": 1, "result": CR{"id": 43}},
+		CR{"jsonrpc": "2.0", "id": 2, "error": CR{
+			"code": -32602, "message": "login len must be >= 10",
+			"data": CR{"status": 400, "code": "validation.min", "field": "login", "rule": "min"},
+		}},
+		CR{"jsonrpc": "2.0", "id": 3, "error": CR{
+			"code": -32602, "message": "age must be int",
+			"data": CR{"status": 400, "code": "validation.type", "field": "age", "rule": "type"},
+		}},
+		CR{"jsonrpc": "2.0", "id": 4, "error": CR{"code": -32601, "message": "method not found"}},
+		CR{"jsonrpc": "2.0", "id": nil, "error": CR{"code": -32600, "message": "invalid request"}},
+	})
+	check(`{"jsonrpc": "2.0", "method"`, false, CR{
+		"jsonrpc": "2.0",
+		"id":      nil,
+		"error":   CR{"code": -32700, "message": "parse error"},
+	})
+	if status, res := rpc(`{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": "rvasily"}}`, false); status != http.StatusNoContent {
+		t.Errorf("expected no content for notification, got %v %s", status, res)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	api := NewMyApi()
+	// the profile of the created user is read after the create
+	api.Handler().BatchConcurrency = 1
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	batch := func(body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/_batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		res, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(res)
+	}
+
+	status, body := batch(`[
+		{"method": "GET", "url": "/user/profile", "params": {"login": "rvasily"}},
+		{"method": "GET", "url": "/user/profile", "params": {"login": "nobody"}},
+		{"method": "POST", "url": "/user/create", "params": {"login": "mr.moderator", "age": 32, "status": "moderator"}},
+		{"method": "POST", "url": "/user/create", "params": {"login": "x", "age": 32}},
+		{"method": "GET", "url": "/v2/user/profile", "params": {"login": "mr.moderator"}},
+		{"method": "POST", "url": "/user/_batch"}
+	]`)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %v: %s", status, body)
+	}
+	var got interface{}
+	json.Unmarshal([]byte(body), &got)
+	var expected interface{}
+	data, _ := json.Marshal([]interface{}{
+		CR{"status": 200, "body": CR{"error": "", "response": CR{"id": 42, "login": "rvasily", "full_name": "Vasily Romanov", "status": 20}}},
+		CR{"status": 404, "body": CR{"error": "user not exist", "code": "user_not_found"}},
+		CR{"status": 200, "body": CR{"error": "", "response": CR{"id": 43}}},
+		CR{"status": 400, "body": CR{"error": "login len must be >= 10", "code": "validation.min", "details": CR{"field": "login"}}},
+		CR{"status": 200, "body": CR{"error": "", "response": CR{"id": 43, "login": "mr.moderator", "full_name": "", "status": 10}}},
+		CR{"status": 404, "body": CR{"error": "unknown method", "code": "not_found"}},
+	})
+	json.Unmarshal(data, &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %s, got %s", data, body)
+	}
+
+	// streams are collected whole, the recorder does not flush
+	status, body = batch(`[{"url": "/user/export", "params": {"limit": 1}}]`)
+	expectedExport := `[{"status":200,"body":{"error":"","response":{"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}}}]`
+	if status != http.StatusOK || body != expectedExport {
+		t.Errorf("expected %s, got %v %s", expectedExport, status, body)
+	}
+
+	items := make([]string, 21)
+	for i := range items {
+		items[i] = `{"url": "/user/profile", "params": {"login": "rvasily"}}`
+	}
+	if status, body := batch("[" + strings.Join(items, ",") + "]"); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for too big batch, got %v: %s", status, body)
+	}
+
+	huge := `[{"method": "POST", "url": "/user/create", "params": {"login": "` + strings.Repeat("a", 2<<20) + `"}}]`
+	expectedHuge := `{"code":"body_too_large","error":"request body must be at most 1048576 bytes"}`
+	if status, body := batch(huge); status != http.StatusRequestEntityTooLarge || body != expectedHuge {
+		t.Errorf("expected 413 %s for too big body, got %v: %s", expectedHuge, status, body)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	get := func(query, accept string) (int, string, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+ApiUserProfile+"?"+query, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	cases := []struct {
+		Query       string
+		Accept      string
+		Status      int
+		ContentType string
+		Body        string
+	}{
+		{"login=rvasily", "application/xml", 200, "application/xml",
+			xml.Header + "<envelope><error></error><response><id>42</id><login>rvasily</login><full_name>Vasily Romanov</full_name><status>20</status></response></envelope>"},
+		{"login=nobody", "text/xml", 404, "application/xml",
+			xml.Header + "<envelope><error>user not exist</error><code>user_not_found</code></envelope>"},
+		{"login=", "application/xml", 400, "application/xml",
+			xml.Header + `<envelope><error>login must me not empty</error><code>validation.required</code><details><detail name="field">login</detail></details></envelope>`},
+		{"login=nobody", "text/plain, application/json;q=0.5", 404, "text/plain; charset=utf-8", "user not exist\n"},
+		{"login=rvasily", "text/plain", 406, "text/plain; charset=utf-8", "not acceptable\n"},
+		{"login=rvasily", "text/html;q=0.9, application/json;q=0.5, application/xml;q=0.1", 200, "application/json",
+			`{"error":"","response":{"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}}`},
+		{"login=rvasily", "image/png", 406, "application/json", `{"error":"not acceptable","code":"not_acceptable"}`},
+	}
+	for _, c := range cases {
+		status, contentType, body := get(c.Query, c.Accept)
+		if status != c.Status || contentType != c.ContentType || body != c.Body {
+			t.Errorf("for %s accepting %s expected %v %s %q, got %v %s %q",
+				c.Query, c.Accept, c.Status, c.ContentType, c.Body, status, contentType, body)
+		}
+	}
+
+	// a success that can not be answered is not made
+	create := func(accept string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader("login=plain.text&full_name=Plain&age=20"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := create("text/plain"); status != http.StatusNotAcceptable {
+		t.Errorf("expected 406 for text only, got %v", status)
+	}
+	if status := create("application/json"); status != http.StatusOK {
+		t.Errorf("expected user to be created by the next request, got %v", status)
+	}
+}
+
+func TestStream(t *testing.T) {
+	api := NewMyApi()
+	api.Create(context.Background(), CreateParams{Login: "mr.moderator", Name: "Ivan", Status: "moderator"})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	get := func(path string) (int, string, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	cases := []struct {
+		Path        string
+		Status      int
+		ContentType string
+		Body        string
+	}{
+		{"/user/export?limit=0", 200, "application/x-ndjson",
+			`{"error":"","response":{"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}}` + "\n" +
+				`{"error":"","response":{"id":43,"login":"mr.moderator","full_name":"Ivan","status":10}}` + "\n"},
+		{"/user/feed?limit=1", 200, "text/event-stream",
+			`data: {"id":42,"login":"rvasily","full_name":"Vasily Romanov","status":20}` + "\n\n"},
+		{"/user/export?limit=-1", 400, "application/json", `{"error":"limit must be \u003e= 0","code":"validation.min","details":{"field":"limit"}}`},
+	}
+	for _, c := range cases {
+		status, contentType, body := get(c.Path)
+		if status != c.Status || contentType != c.ContentType || body != c.Body {
+			t.Errorf("for %s expected %v %s %q, got %v %s %q",
+				c.Path, c.Status, c.ContentType, c.Body, status, contentType, body)
+		}
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	mock := &MyApiMock{
+		ExportFunc: func(ctx context.Context, in ExportParams) (<-chan *User, error) {
+			if in.Limit == 0 {
+				return nil, ApiError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("export is running"), Code: "export_running"}
+			}
+			out := make(chan *User, 1)
+			out <- &User{ID: 1, Login: "first"}
+			close(out)
+			return out, nil
+		},
+		FeedFunc: func(ctx context.Context, in ExportParams, send func(*User) error) error {
+			if err := send(&User{ID: 1, Login: "first"}); err != nil {
+				return err
+			}
+			return fmt.Errorf("storage is gone")
+		},
+	}
+	ts := httptest.NewServer(NewMyApiHandler(mock))
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// nothing is sent yet, the error is a usual response
+	if status, body := get("/user/export?limit=0"); status != http.StatusConflict || body != `{"error":"export is running","code":"export_running"}` {
+		t.Errorf("unexpected export error: %v %q", status, body)
+	}
+	if status, body := get("/user/export?limit=1"); status != http.StatusOK ||
+		body != `{"error":"","response":{"id":1,"login":"first","full_name":"","status":0}}`+"\n" {
+		t.Errorf("unexpected export: %v %q", status, body)
+	}
+	// the error after the first item is the final event
+	expected := `data: {"id":1,"login":"first","full_name":"","status":0}` + "\n\n" +
+		"event: error\n" + `data: {"error":"storage is gone"}` + "\n\n"
+	if status, body := get("/user/feed?limit=0"); status != http.StatusOK || body != expected {
+		t.Errorf("unexpected feed: %v %q", status, body)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	stopped := make(chan error, 1)
+	mock := &MyApiMock{
+		FeedFunc: func(ctx context.Context, in ExportParams, send func(*User) error) error {
+			for i := 1; ; i++ {
+				if err := send(&User{ID: uint64(i)}); err != nil {
+					stopped <- err
+					return err
+				}
+				time.Sleep(time.Millisecond)
+			}
+		},
+	}
+	ts := httptest.NewServer(NewMyApiHandler(mock))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/user/feed?limit=0", nil)
+	req.Header.Set("X-Auth", "100500")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, `data: {"id":1,`) {
+		t.Fatalf("expected the first event, got %q %v", line, err)
+	}
+	// the client goes away in the middle of the stream
+	cancel()
+	resp.Body.Close()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Errorf("expected send to fail")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("stream goes on after the client is gone")
+	}
+}
+
+func TestAvatarUpload(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+	upload := func(login string, file []byte) (int, string) {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		mw.WriteField("login", login)
+		if file != nil {
+			part, _ := mw.CreateFormFile("avatar", "avatar.png")
+			part.Write(file)
+		}
+		mw.Close()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/avatar", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	cases := []struct {
+		Login  string
+		File   []byte
+		Status int
+		Body   string
+	}{
+		{"rvasily", png, 200, `{"error":"","response":{"login":"rvasily","size":108}}`},
+		{"rvasily", nil, 400, `{"error":"avatar must me not empty","code":"validation.required","details":{"field":"avatar"}}`},
+		{"rvasily", []byte("GIF89a"), 400, `{"error":"avatar must be one of [image/png, image/jpeg]","code":"validation.mimetype","details":{"field":"avatar"}}`},
+		{"rvasily", append(png, make([]byte, 5<<20)...), 400, `{"error":"avatar size must be \u003c= 5242880 bytes","code":"validation.maxsize","details":{"field":"avatar"}}`},
+		{"nobody", png, 404, `{"error":"user not exist","code":"user_not_found"}`},
+		{"rvasily", append(png, make([]byte, 6<<20)...), 413, `{"error":"request body must be at most 6291456 bytes","code":"body_too_large"}`},
+	}
+	for ix, c := range cases {
+		status, body := upload(c.Login, c.File)
+		if status != c.Status || body != c.Body {
+			t.Errorf("[%d] expected %v %q, got %v %q", ix, c.Status, c.Body, status, body)
+		}
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	post := func(path, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		res, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(res)
+	}
+
+	cases := []struct {
+		Path   string
+		Body   string
+		Status int
+		Result string
+	}{
+		{ApiUserCreate, "login=mr.moderator&age=32&full_name=Ivan&status=user", 200, `{"error":"","response":{"id":43}}`},
+		{ApiUserCreate, "login=mr.moderator2&age=32&admin=true&debug=1", 400, `{"error":"unknown param admin","code":"validation.unknown","details":{"field":"admin"}}`},
+		{ApiUserCreate + "?trace=1", "login=mr.moderator2&age=32", 400, `{"error":"unknown param trace","code":"validation.unknown","details":{"field":"trace"}}`},
+		{ApiUserCreate, "login=mr.moderator2&age=32&full_name=" + strings.Repeat("x", 1<<20), 413, `{"error":"request body must be at most 1048576 bytes","code":"body_too_large"}`},
+		{ApiUserCreate, "login=%zz", 400, `{"error":"bad request body","code":"bad_body"}`},
+	}
+	for ix, c := range cases {
+		status, res := post(c.Path, c.Body)
+		if status != c.Status || res != c.Result {
+			t.Errorf("[%d] expected %v %q, got %v %q", ix, c.Status, c.Result, status, res)
+		}
+	}
+
+	// profile is not strict
+	resp, err := client.Get(ts.URL + ApiUserProfile + "?login=rvasily&debug=1")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for unknown param of profile, got %v", resp.StatusCode)
+	}
+
+	rpcHandler := NewJSONRPCHandler(NewMyApi().Handler(), NewOtherApiHandler(NewOtherApi()))
+	rpc := httptest.NewServer(rpcHandler)
+	defer rpc.Close()
+	call := func(body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, rpc.URL, strings.NewReader(body))
+		req.Header.Set("X-Auth", "100500")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		res, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(res)
+	}
+	rpcCases := []struct {
+		Body   string
+		Status int
+		Result string
+	}{
+		{`{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32, "admin": true}, "id": 1}`, 200,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"unknown param admin","data":{"code":"validation.unknown","field":"admin","rule":"unknown","status":400}},"id":1}`},
+		// the body is over the largest max_body of the methods
+		{`{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32, "full_name": "` + strings.Repeat("x", 3<<20) + `"}, "id": 2}`, 413,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"request body must be at most 1048576 bytes"},"id":null}`},
+	}
+	for ix, c := range rpcCases {
+		if status, res := call(c.Body); status != c.Status || res != c.Result {
+			t.Errorf("[rpc %d] expected %v %s, got %v %s", ix, c.Status, c.Result, status, res)
+		}
+	}
+
+	// params of a call are over max_body of its method
+	rpcHandler.MaxBody = 0
+	status, res := call(`{"jsonrpc": "2.0", "method": "MyApi.Create", "params": {"login": "mr.moderator", "age": 32, "full_name": "` + strings.Repeat("x", 2<<20) + `"}, "id": 3}`)
+	expected := `{"jsonrpc":"2.0","error":{"code":-32000,"message":"request body must be at most 1048576 bytes","data":{"code":"body_too_large","status":413}},"id":3}`
+	if status != http.StatusOK || res != expected {
+		t.Errorf("expected 200 %s, got %v %s", expected, status, res)
+	}
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi())
+	defer ts.Close()
+
+	post := func(query, lang string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader(query))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	cases := []struct {
+		Query  string
+		Lang   string
+		Result string
+	}{
+		{"login=x&age=1", "ru", `{"error":"длина параметра login должна быть \u003e= 10","code":"validation.min","details":{"field":"login"}}`},
+		{"login=mr.moderator&age=200", "ru-RU,ru;q=0.9,en;q=0.8", `{"error":"параметр age должен быть \u003c= 128","code":"validation.max","details":{"field":"age"}}`},
+		{"login=mr.moderator&age=1&status=root", "en;q=0.9,ru;q=0.5", `{"error":"status must be one of [user, moderator, admin]","code":"validation.enum","details":{"field":"status"}}`},
+		{"login=mr.moderator&age=old", "de", `{"error":"age must be int","code":"validation.type","details":{"field":"age"}}`},
+		{"age=1", "", `{"error":"login must me not empty","code":"validation.required","details":{"field":"login"}}`},
+		{"login=mr.moderator&age=1&admin=1", "ru", `{"error":"неизвестный параметр admin","code":"validation.unknown","details":{"field":"admin"}}`},
+	}
+	for ix, c := range cases {
+		status, body := post(c.Query, c.Lang)
+		if status != http.StatusBadRequest || body != c.Result {
+			t.Errorf("[%d] expected 400 %s, got %v %s", ix, c.Result, status, body)
+		}
+	}
+
+	rpc := httptest.NewServer(NewJSONRPCHandler(NewMyApi().Handler(), NewOtherApiHandler(NewOtherApi())))
+	defer rpc.Close()
+	req, _ := http.NewRequest(http.MethodPost, rpc.URL, strings.NewReader(
+		`{"jsonrpc": "2.0", "method": "MyApi.Profile", "params": {"login": ""}, "id": 1}`))
+	req.Header.Set("Accept-Language", "ru")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	expected := `{"jsonrpc":"2.0","error":{"code":-32602,"message":"параметр login не должен быть пустым","data":{"code":"validation.required","field":"login","rule":"required","status":400}},"id":1}`
+	if string(body) != expected {
+		t.Errorf("expected %s, got %s", expected, body)
+	}
+}